@@ -84,6 +84,17 @@ impl Apath {
         }
     }
 
+    /// Number of directories between the root and this path: 0 for the root,
+    /// 1 for its children, and so on.
+    #[must_use]
+    pub fn depth(&self) -> usize {
+        if self.0 == "/" {
+            0
+        } else {
+            self.0.matches('/').count()
+        }
+    }
+
     /// Return a PathBuf for this Apath below a tree root directory.
     #[must_use]
     pub fn below<R: Into<PathBuf>>(&self, tree_root: R) -> PathBuf {
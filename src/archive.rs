@@ -25,7 +25,7 @@ use nutmeg::models::{LinearModel, UnboundedModel};
 use rayon::prelude::*;
 use serde::{Deserialize, Serialize};
 
-use crate::blockhash::BlockHash;
+use crate::blockhash::{BlockHash, HashAlgorithm};
 use crate::errors::Error;
 use crate::jsonio::{read_json, write_json};
 use crate::kind::Kind;
@@ -35,8 +35,16 @@ use crate::transport::local::LocalTransport;
 use crate::transport::{DirEntry, Transport};
 use crate::*;
 
-const HEADER_FILENAME: &str = "CONSERVE";
+pub(crate) const HEADER_FILENAME: &str = "CONSERVE";
 static BLOCK_DIR: &str = "d";
+/// Damaged blocks are moved here by `validate --repair`.
+static QUARANTINE_DIR: &str = "quarantine";
+
+/// Smallest block size that can be configured for an archive.
+pub const MIN_BLOCK_SIZE: usize = 4 << 10;
+
+/// Largest block size that can be configured for an archive.
+pub const LARGEST_BLOCK_SIZE: usize = 64 << 20;
 
 /// An archive holding backup material.
 #[derive(Clone, Debug)]
@@ -45,11 +53,51 @@ pub struct Archive {
     block_dir: BlockDir,
 
     transport: Arc<dyn Transport>,
+
+    /// Maximum size of blocks written by backups.
+    block_size: usize,
+
+    /// Algorithm used to name blocks.
+    hash_algorithm: HashAlgorithm,
+
+    /// Salt for deriving the manifest key from a passphrase, if the archive
+    /// is signed.
+    manifest_salt: Option<String>,
 }
 
 #[derive(Debug, Serialize, Deserialize)]
 struct ArchiveHeader {
     conserve_archive_version: String,
+
+    /// Block size chosen when the archive was created, if it's not the
+    /// default.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    block_size: Option<usize>,
+
+    /// Hash algorithm used to name blocks, if it's not the default Blake2b.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    hash_algorithm: Option<HashAlgorithm>,
+
+    /// If the archive has a signed manifest, the salt for deriving its key
+    /// from a passphrase.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    manifest_salt: Option<String>,
+}
+
+/// Options for creating a new archive.
+#[derive(Debug, Clone, Default, Eq, PartialEq)]
+pub struct ArchiveOptions {
+    /// Maximum size of blocks written by backups, or `None` for the default.
+    pub block_size: Option<usize>,
+
+    /// Algorithm used to name blocks.
+    pub hash_algorithm: HashAlgorithm,
+
+    /// Keep a signed manifest of the archive's contents.
+    ///
+    /// The caller should write the first manifest with
+    /// `manifest::write_manifest` once the archive is created.
+    pub signed: bool,
 }
 
 #[derive(Default, Debug)]
@@ -66,6 +114,27 @@ impl Archive {
 
     /// Make a new archive in a new directory accessed by a Transport.
     pub fn create(transport: Box<dyn Transport>) -> Result<Archive> {
+        Archive::create_with_options(transport, &ArchiveOptions::default())
+    }
+
+    /// Make a new archive with the given block size and hash algorithm.
+    ///
+    /// Returns `Err(Error::InvalidBlockSize)` if the size is outside
+    /// `MIN_BLOCK_SIZE..=LARGEST_BLOCK_SIZE`.
+    pub fn create_with_options(
+        transport: Box<dyn Transport>,
+        options: &ArchiveOptions,
+    ) -> Result<Archive> {
+        let block_size = options.block_size;
+        let hash_algorithm = options.hash_algorithm;
+        let manifest_salt = if options.signed {
+            Some(crate::manifest::generate_salt()?)
+        } else {
+            None
+        };
+        if let Some(block_size) = block_size {
+            check_block_size(block_size)?;
+        }
         transport
             .create_dir("")
             .map_err(|source| Error::CreateArchiveDirectory { source })?;
@@ -73,17 +142,36 @@ impl Archive {
         if !names.files.is_empty() || !names.dirs.is_empty() {
             return Err(Error::NewArchiveDirectoryNotEmpty);
         }
-        let block_dir = BlockDir::create(transport.sub_transport(BLOCK_DIR))?;
+        let block_dir = BlockDir::create(transport.sub_transport(BLOCK_DIR))?
+            .with_hash_algorithm(hash_algorithm);
+        // Older versions ignore the block size, hash algorithm, and manifest,
+        // so would write blocks of the wrong size, report every block as
+        // corrupt, or change the archive without updating its manifest.
+        let archive_version = if block_size.is_none()
+            && hash_algorithm == HashAlgorithm::default()
+            && manifest_salt.is_none()
+        {
+            ARCHIVE_VERSION
+        } else {
+            EXTENDED_ARCHIVE_VERSION
+        };
         write_json(
             &transport,
             HEADER_FILENAME,
             &ArchiveHeader {
-                conserve_archive_version: String::from(ARCHIVE_VERSION),
+                conserve_archive_version: String::from(archive_version),
+                block_size,
+                hash_algorithm: (hash_algorithm != HashAlgorithm::default())
+                    .then(|| hash_algorithm),
+                manifest_salt: manifest_salt.clone(),
             },
         )?;
         Ok(Archive {
             block_dir,
             transport: Arc::from(transport),
+            block_size: block_size.unwrap_or(MAX_BLOCK_SIZE),
+            hash_algorithm,
+            manifest_salt,
         })
     }
 
@@ -104,15 +192,25 @@ impl Archive {
                 Error::IOError { source } => Error::ReadArchiveHeader { source },
                 other => other,
             })?;
-        if header.conserve_archive_version != ARCHIVE_VERSION {
+        if header.conserve_archive_version != ARCHIVE_VERSION
+            && header.conserve_archive_version != EXTENDED_ARCHIVE_VERSION
+        {
             return Err(Error::UnsupportedArchiveVersion {
                 version: header.conserve_archive_version,
             });
         }
-        let block_dir = BlockDir::open(transport.sub_transport(BLOCK_DIR));
+        if let Some(block_size) = header.block_size {
+            check_block_size(block_size)?;
+        }
+        let hash_algorithm = header.hash_algorithm.unwrap_or_default();
+        let block_dir =
+            BlockDir::open(transport.sub_transport(BLOCK_DIR)).with_hash_algorithm(hash_algorithm);
         Ok(Archive {
             block_dir,
             transport: Arc::from(transport),
+            block_size: header.block_size.unwrap_or(MAX_BLOCK_SIZE),
+            hash_algorithm,
+            manifest_salt: header.manifest_salt,
         })
     }
 
@@ -120,6 +218,26 @@ impl Archive {
         &self.block_dir
     }
 
+    /// Return the maximum size of blocks written by backups to this archive.
+    pub fn block_size(&self) -> usize {
+        self.block_size
+    }
+
+    /// Return the algorithm used to name blocks in this archive.
+    pub fn hash_algorithm(&self) -> HashAlgorithm {
+        self.hash_algorithm
+    }
+
+    /// True if this archive keeps a signed manifest, which should be
+    /// rewritten after every change.
+    pub fn is_signed(&self) -> bool {
+        self.manifest_salt.is_some()
+    }
+
+    pub(crate) fn manifest_salt(&self) -> Option<&str> {
+        self.manifest_salt.as_deref()
+    }
+
     pub fn band_exists(&self, band_id: &BandId) -> Result<bool> {
         self.transport
             .is_file(&format!("{}/{}", band_id, crate::BAND_HEAD_FILENAME))
@@ -149,9 +267,48 @@ impl Archive {
                 .last_complete_band()?
                 .map(|band| band.id().clone())
                 .ok_or(Error::ArchiveEmpty),
-            BandSelectionPolicy::Specified(band_id) => Ok(band_id),
+            BandSelectionPolicy::Specified(band_id) => {
+                if self.band_exists(&band_id)? {
+                    Ok(band_id)
+                } else {
+                    Err(Error::BandNotFound {
+                        band_id,
+                        available: self.list_band_ids()?,
+                    })
+                }
+            }
             BandSelectionPolicy::Latest => self.last_band_id()?.ok_or(Error::ArchiveEmpty),
+            BandSelectionPolicy::Labelled(label) => {
+                let mut matches = self.band_ids_with_label(&label)?;
+                match matches.len() {
+                    0 => Err(Error::LabelNotFound { label }),
+                    1 => Ok(matches.remove(0)),
+                    _ => Err(Error::AmbiguousLabel {
+                        label,
+                        band_ids: matches,
+                    }),
+                }
+            }
+        }
+    }
+
+    /// Return the ids of all bands with this label, in order.
+    ///
+    /// Bands that can't be opened are reported and skipped.
+    pub fn band_ids_with_label(&self, label: &str) -> Result<Vec<BandId>> {
+        let mut matches = Vec::new();
+        for band_id in self.list_band_ids()? {
+            match Band::open(self, &band_id) {
+                Ok(band) if band.label() == Some(label) => matches.push(band_id),
+                Ok(_) => (),
+                Err(err) => ui::problem(&format!(
+                    "Failed to open band {:?}: {}",
+                    band_id,
+                    ui::format_error_causes(&err)
+                )),
+            }
         }
+        Ok(matches)
     }
 
     pub fn open_stored_tree(&self, band_selection: BandSelectionPolicy) -> Result<StoredTree> {
@@ -210,6 +367,43 @@ impl Archive {
             .collect())
     }
 
+    /// Summarize the versions and blocks in the archive.
+    ///
+    /// This reads only the band metadata, the indexes, and the sizes of the
+    /// block files, not the content of any blocks.
+    pub fn stats(&self) -> Result<ArchiveStats> {
+        let band_ids = self.list_band_ids()?;
+        let mut stats = ArchiveStats {
+            versions: band_ids.len(),
+            ..ArchiveStats::default()
+        };
+        // The uncompressed size of each block is at least the end of the
+        // furthest reference into it.
+        let mut block_lens: HashMap<BlockHash, u64> = HashMap::new();
+        for band_id in &band_ids {
+            let band = Band::open(self, band_id)?;
+            let start_time = band.get_info()?.start_time;
+            stats.oldest_version_time = stats.oldest_version_time.or(Some(start_time));
+            stats.newest_version_time = Some(start_time);
+            for entry in band.index().iter_entries() {
+                for addr in entry.addrs {
+                    stats.logical_bytes += addr.len;
+                    let end = block_lens.entry(addr.hash).or_default();
+                    *end = (*end).max(addr.start + addr.len);
+                }
+            }
+        }
+        stats.unique_bytes = block_lens.values().sum();
+        let block_dir = self.block_dir();
+        for hash in block_dir.block_names()? {
+            stats.blocks += 1;
+            stats.stored_bytes += block_dir.compressed_size(&hash)?;
+        }
+        stats.dedup_ratio = crate::stats::ratio(stats.logical_bytes, stats.unique_bytes);
+        stats.compression_ratio = crate::stats::ratio(stats.unique_bytes, stats.stored_bytes);
+        Ok(stats)
+    }
+
     /// Returns an iterator of blocks that are present and referenced by no index.
     pub fn unreferenced_blocks(&self) -> Result<impl Iterator<Item = BlockHash>> {
         let referenced = self.referenced_blocks(&self.list_band_ids()?)?;
@@ -298,7 +492,13 @@ impl Archive {
         Ok(stats)
     }
 
+    /// Check the archive for problems, and return counts of what was found.
     pub fn validate(&self, options: &ValidateOptions) -> Result<ValidateStats> {
+        self.validate_report(options).map(|report| report.stats)
+    }
+
+    /// Check the archive for problems, and return a report of what was found.
+    pub fn validate_report(&self, options: &ValidateOptions) -> Result<ValidateReport> {
         let start = Instant::now();
         let mut stats = self.validate_archive_dir()?;
 
@@ -310,6 +510,9 @@ impl Archive {
         //    values referenced by all the indexes.
         let (referenced_lens, ref_stats) = validate::validate_bands(self, &band_ids);
         stats += ref_stats;
+        let mut bad_blocks: HashSet<BlockHash> = HashSet::new();
+        // Blocks that are present but can't be read or have the wrong hash.
+        let mut damaged_blocks: HashSet<BlockHash> = HashSet::new();
 
         if options.skip_block_hashes {
             // 3a. Check that all referenced blocks are present, without spending time reading their
@@ -324,12 +527,21 @@ impl Archive {
             {
                 ui::problem(&format!("Block {:?} is missing", block_hash));
                 stats.block_missing_count += 1;
+                bad_blocks.insert(block_hash.clone());
             }
         } else {
             // 2. Check the hash of all blocks are correct, and remember how long
             //    the uncompressed data is.
             ui::println("Check blockdir...");
             let block_lengths: HashMap<BlockHash, usize> = self.block_dir.validate(&mut stats)?;
+            if options.repair && stats.block_error_count > 0 {
+                damaged_blocks = self
+                    .block_dir
+                    .block_names_set()?
+                    .into_iter()
+                    .filter(|hash| !block_lengths.contains_key(hash))
+                    .collect();
+            }
             // 3b. Check that all referenced ranges are inside the present data.
             for (block_hash, referenced_len) in referenced_lens.0 {
                 if let Some(actual_len) = block_lengths.get(&block_hash) {
@@ -337,16 +549,56 @@ impl Archive {
                         ui::problem(&format!("Block {:?} is too short", block_hash,));
                         // TODO: A separate counter; this is worse than just being missing
                         stats.block_missing_count += 1;
+                        bad_blocks.insert(block_hash);
                     }
                 } else {
                     ui::problem(&format!("Block {:?} is missing", block_hash));
                     stats.block_missing_count += 1;
+                    bad_blocks.insert(block_hash);
                 }
             }
         }
 
+        let damaged_files = if bad_blocks.is_empty() {
+            Vec::new()
+        } else {
+            // 4. Say which files are affected, which needs another pass over the indexes.
+            validate::report_damaged_files(self, &band_ids, &bad_blocks)
+        };
+
+        let (quarantined_blocks, unrecoverable_files) = if options.repair {
+            validate::repair(self, &damaged_blocks, &damaged_files)?
+        } else {
+            (Vec::new(), Vec::new())
+        };
+
         stats.elapsed = start.elapsed();
-        Ok(stats)
+        Ok(ValidateReport {
+            ok: !stats.has_problems(),
+            bands: band_ids,
+            stats,
+            damaged_files,
+            quarantined_blocks,
+            unrecoverable_files,
+        })
+    }
+
+    /// Mark the archive as version `EXTENDED_ARCHIVE_VERSION`, if it's not
+    /// already, before storing something older versions can't read.
+    pub(crate) fn require_extended_version(&self) -> Result<()> {
+        let mut header: ArchiveHeader = read_json(&self.transport, HEADER_FILENAME)?;
+        if header.conserve_archive_version != EXTENDED_ARCHIVE_VERSION {
+            header.conserve_archive_version = EXTENDED_ARCHIVE_VERSION.to_owned();
+            write_json(&self.transport, HEADER_FILENAME, &header)?;
+        }
+        Ok(())
+    }
+
+    /// Return a transport for the quarantine directory, creating it if
+    /// necessary.
+    pub(crate) fn quarantine_transport(&self) -> Result<Box<dyn Transport>> {
+        self.transport.create_dir(QUARANTINE_DIR)?;
+        Ok(self.transport.sub_transport(QUARANTINE_DIR))
     }
 
     fn validate_archive_dir(&self) -> Result<ValidateStats> {
@@ -380,6 +632,7 @@ impl Archive {
             }
         }
         remove_item(&mut files, &HEADER_FILENAME);
+        remove_item(&mut files, &crate::manifest::MANIFEST_FILENAME);
         if !files.is_empty() {
             // TODO: Ignore .DS_Store
             stats.unexpected_files += 1;
@@ -389,6 +642,7 @@ impl Archive {
             ));
         }
         remove_item(&mut dirs, &BLOCK_DIR);
+        remove_item(&mut dirs, &QUARANTINE_DIR);
         dirs.sort();
         let mut bs = HashSet::<BandId>::new();
         for d in dirs.iter() {
@@ -414,6 +668,21 @@ impl Archive {
     }
 }
 
+fn check_block_size(block_size: usize) -> Result<()> {
+    if (MIN_BLOCK_SIZE..=LARGEST_BLOCK_SIZE).contains(&block_size) {
+        Ok(())
+    } else {
+        Err(Error::InvalidBlockSize { block_size })
+    }
+}
+
+/// Parse a block size such as `4MiB` for a new archive.
+pub fn parse_block_size(s: &str) -> std::result::Result<usize, String> {
+    let block_size = crate::misc::parse_bytes(s)? as usize;
+    check_block_size(block_size).map_err(|err| err.to_string())?;
+    Ok(block_size)
+}
+
 #[cfg(test)]
 mod tests {
     use std::fs;
@@ -520,4 +789,126 @@ mod tests {
         );
         assert_eq!(af.block_dir.block_names().unwrap().count(), 0);
     }
+
+    #[test]
+    fn stats_of_two_versions() {
+        let af = ScratchArchive::new();
+        af.store_two_versions();
+        let stats = af.stats().unwrap();
+        assert_eq!(stats.versions, 2);
+        assert!(stats.oldest_version_time.unwrap() <= stats.newest_version_time.unwrap());
+        // Two files of 8 bytes in the first version, and three in the second.
+        assert_eq!(stats.logical_bytes, 40);
+        assert!(stats.unique_bytes > 0 && stats.unique_bytes < stats.logical_bytes);
+        assert!(stats.dedup_ratio > 1.0);
+        assert_eq!(stats.blocks, af.block_dir.block_names().unwrap().count());
+        assert!(stats.stored_bytes > 0);
+    }
+
+    #[test]
+    fn configured_block_size_limits_blocks() {
+        let temp = TempDir::new().unwrap();
+        let archive = Archive::create_with_options(
+            Box::new(LocalTransport::new(temp.path())),
+            &ArchiveOptions {
+                block_size: Some(8 << 10),
+                ..ArchiveOptions::default()
+            },
+        )
+        .unwrap();
+        let srcdir = crate::test_fixtures::TreeFixture::new();
+        let content: Vec<u8> = (0..100_000u32).map(|i| (i * 7 % 251) as u8).collect();
+        srcdir.create_file_with_contents("large", &content);
+        backup(&archive, &srcdir.live_tree(), &BackupOptions::default()).unwrap();
+
+        // Older versions of Conserve refuse to open the archive, rather than
+        // writing blocks of the default size.
+        let header = fs::read_to_string(temp.path().join("CONSERVE")).unwrap();
+        assert_eq!(
+            header,
+            "{\"conserve_archive_version\":\"0.6.17\",\"block_size\":8192}\n"
+        );
+        let archive = Archive::open_path(temp.path()).unwrap();
+        assert_eq!(archive.block_size(), 8 << 10);
+        let band = Band::open(&archive, &BandId::zero()).unwrap();
+        let entry = band
+            .index()
+            .iter_entries()
+            .find(|entry| entry.apath == "/large")
+            .unwrap();
+        assert_eq!(entry.addrs.len(), 13);
+        assert!(entry.addrs.iter().all(|addr| addr.len <= 8 << 10));
+    }
+
+    #[test]
+    fn invalid_block_size() {
+        let temp = TempDir::new().unwrap();
+        let result = Archive::create_with_options(
+            Box::new(LocalTransport::new(temp.path())),
+            &ArchiveOptions {
+                block_size: Some(1000),
+                ..ArchiveOptions::default()
+            },
+        );
+        assert!(matches!(
+            result,
+            Err(Error::InvalidBlockSize { block_size: 1000 })
+        ));
+        assert_eq!(parse_block_size("4KiB"), Ok(4096));
+        assert_eq!(parse_block_size("64MiB"), Ok(64 << 20));
+        assert!(parse_block_size("1GB").is_err());
+    }
+
+    #[test]
+    fn other_hash_algorithms_back_up_and_restore() {
+        for hash_algorithm in [HashAlgorithm::Sha256, HashAlgorithm::Blake3] {
+            let temp = TempDir::new().unwrap();
+            let archive_path = temp.path().join("archive");
+            Archive::create_with_options(
+                Box::new(LocalTransport::new(&archive_path)),
+                &ArchiveOptions {
+                    hash_algorithm,
+                    ..ArchiveOptions::default()
+                },
+            )
+            .unwrap();
+            let srcdir = crate::test_fixtures::TreeFixture::new();
+            srcdir.create_file_with_contents("hello", b"hello world\n");
+
+            // Older versions of Conserve refuse to open the archive.
+            let header = fs::read_to_string(archive_path.join("CONSERVE")).unwrap();
+            assert!(
+                header.starts_with("{\"conserve_archive_version\":\"0.6.17\","),
+                "{}",
+                header
+            );
+
+            let archive = Archive::open_path(&archive_path).unwrap();
+            assert_eq!(archive.hash_algorithm(), hash_algorithm);
+            backup(&archive, &srcdir.live_tree(), &BackupOptions::default()).unwrap();
+            let block_names: Vec<String> = archive
+                .block_dir()
+                .block_names()
+                .unwrap()
+                .map(|hash| hash.to_string())
+                .collect();
+            assert_eq!(block_names.len(), 1);
+            assert_eq!(block_names[0].len(), 64);
+            assert_eq!(
+                block_names[0],
+                hash_algorithm.hash(b"hello world\n").to_string()
+            );
+
+            assert!(!archive
+                .validate(&ValidateOptions::default())
+                .unwrap()
+                .has_problems());
+            let restore_path = temp.path().join("restore");
+            restore(&archive, &restore_path, &RestoreOptions::default()).unwrap();
+            assert_eq!(
+                std::fs::read(restore_path.join("hello")).unwrap(),
+                b"hello world\n"
+            );
+        }
+    }
 }
@@ -14,10 +14,15 @@
 //! Make a backup by walking a source directory and copying the contents
 //! into an archive.
 
+use std::collections::HashSet;
+use std::convert::TryInto;
 use std::io::prelude::*;
-use std::{convert::TryInto, time::Instant};
+use std::path::Path;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
 
 use itertools::Itertools;
+use rayon::prelude::*;
 
 use crate::blockdir::Address;
 use crate::io::read_with_retries;
@@ -36,6 +41,41 @@ pub struct BackupOptions {
     pub exclude: Exclude,
 
     pub max_entries_per_hunk: usize,
+
+    /// Scan the source and report what would be stored, but don't write
+    /// anything to the archive.
+    pub dry_run: bool,
+
+    /// Read back each block after it's stored, and check that its hash is
+    /// still correct.
+    pub verify: bool,
+
+    /// Break a lock left behind by a previous backup that was interrupted.
+    pub break_lock: bool,
+
+    /// Split large files at content-defined boundaries with these sizes,
+    /// rather than into fixed-size blocks.
+    pub chunk_sizes: Option<ChunkSizes>,
+
+    /// Only store files and symlinks modified at or after this time, and the
+    /// directories that contain them.
+    pub since: Option<chrono::DateTime<chrono::Utc>>,
+
+    /// Don't store files larger than this many bytes.
+    pub exclude_larger_than: Option<u64>,
+
+    /// Don't store files smaller than this many bytes.
+    pub exclude_smaller_than: Option<u64>,
+
+    /// Free-text label to store in the new band.
+    pub label: Option<String>,
+
+    /// Told about files and blocks as they're stored.
+    pub observer: Option<Arc<dyn Observer>>,
+
+    /// Key to rewrite the manifest of a signed archive once the backup is
+    /// finished, or has failed, before the lock is released.
+    pub manifest_key: Option<ManifestKey>,
 }
 
 impl Default for BackupOptions {
@@ -44,6 +84,16 @@ impl Default for BackupOptions {
             print_filenames: false,
             exclude: Exclude::nothing(),
             max_entries_per_hunk: crate::index::MAX_ENTRIES_PER_HUNK,
+            dry_run: false,
+            verify: false,
+            break_lock: false,
+            chunk_sizes: None,
+            since: None,
+            exclude_larger_than: None,
+            exclude_smaller_than: None,
+            label: None,
+            observer: None,
+            manifest_key: None,
         }
     }
 }
@@ -60,8 +110,8 @@ impl Default for BackupOptions {
 //     progress_bar.set_bytes_total(source.size()?.file_bytes as u64);
 // }
 
-#[derive(Default)]
 struct ProgressModel {
+    start: Instant,
     filename: String,
     scanned_file_bytes: u64,
     scanned_dirs: usize,
@@ -75,32 +125,98 @@ struct ProgressModel {
 impl nutmeg::Model for ProgressModel {
     fn render(&mut self, _width: usize) -> String {
         format!(
-            "Scanned {} directories, {} files, {} MB\n{} new entries, {} changed, {} deleted, {} unchanged\n{}",
+            "Scanned {} directories, {} files, {} MB, {:.1} MB/s\n{} new entries, {} changed, {} deleted, {} unchanged\n{}",
             self.scanned_dirs,
             self.scanned_files,
             self.scanned_file_bytes / 1_000_000,
+            mb_per_second(self.scanned_file_bytes, self.start.elapsed()),
             self.entries_new, self.entries_changed, self.entries_deleted, self.entries_unchanged,
             self.filename
         )
     }
 }
 
+/// Throughput in decimal megabytes per second.
+fn mb_per_second(bytes: u64, elapsed: Duration) -> f64 {
+    let secs = elapsed.as_secs_f64();
+    if secs > 0.0 {
+        bytes as f64 / 1e6 / secs
+    } else {
+        0.0
+    }
+}
+
 /// Backup a source directory into a new band in the archive.
 ///
 /// Returns statistics about what was copied.
+///
+/// If `options.dry_run` is set, the source is scanned and the names of new or
+/// changed files are printed, but nothing is written to the archive.
 pub fn backup(
     archive: &Archive,
     source: &LiveTree,
     options: &BackupOptions,
+) -> Result<BackupStats> {
+    if let Some(label) = &options.label {
+        // Otherwise it could never be selected by its label.
+        if label.parse::<BandId>().is_ok() {
+            return Err(Error::InvalidLabel {
+                label: label.clone(),
+            });
+        }
+    }
+    if options.dry_run {
+        return backup_dry_run(archive, source, options);
+    }
+    let _lock = if options.break_lock {
+        BackupLock::break_lock(archive)?
+    } else {
+        BackupLock::new(archive)?
+    };
+    let result = backup_locked(archive, source, options);
+    // A failed backup may still have written blocks and a band, so the
+    // manifest is updated either way, while no one else can change the
+    // archive.
+    if let Some(key) = &options.manifest_key {
+        if let Err(err) = write_manifest(archive, key) {
+            if result.is_ok() {
+                return Err(err);
+            }
+            ui::show_error(&err);
+        }
+    }
+    result
+}
+
+/// Make a backup, once the archive is locked.
+fn backup_locked(
+    archive: &Archive,
+    source: &LiveTree,
+    options: &BackupOptions,
 ) -> Result<BackupStats> {
     let start = Instant::now();
-    let mut writer = BackupWriter::begin(archive)?;
+    let mut writer = BackupWriter::begin(archive, source.path(), options)?;
     let mut stats = BackupStats::default();
-    let mut view = nutmeg::View::new(ProgressModel::default(), ui::nutmeg_options());
-
-    let entry_iter = source.iter_entries(Apath::root(), options.exclude.clone())?;
+    let mut view = nutmeg::View::new(
+        ProgressModel {
+            start,
+            filename: String::new(),
+            scanned_file_bytes: 0,
+            scanned_dirs: 0,
+            scanned_files: 0,
+            entries_new: 0,
+            entries_changed: 0,
+            entries_unchanged: 0,
+            entries_deleted: 0,
+        },
+        ui::nutmeg_options(),
+    );
+
+    let observer = options.observer.as_deref();
+    let entry_iter = source_entries(source, options)?;
     for entry_group in entry_iter.chunks(options.max_entries_per_hunk).into_iter() {
         for entry in entry_group {
+            writer.store_combined_blocks()?;
             view.update(|model| {
                 model.filename = entry.apath().to_string();
                 match entry.kind() {
@@ -109,8 +225,23 @@ pub fn backup(
                     _ => (),
                 }
             });
+            let is_file = entry.kind() == Kind::File;
+            if let Some(observer) = observer.filter(|_| is_file) {
+                observer.file_started(entry.apath());
+            }
             match writer.copy_entry(&entry, source) {
+                // A block that doesn't read back correctly means the archive
+                // can't be trusted, so don't carry on.
+                Err(e @ Error::BlockCorrupt { .. }) => {
+                    if let Some(observer) = observer {
+                        observer.error(entry.apath(), &e);
+                    }
+                    return Err(e);
+                }
                 Err(e) => {
+                    if let Some(observer) = observer {
+                        observer.error(entry.apath(), &e);
+                    }
                     writeln!(view, "{}", ui::format_error_causes(&e))?;
                     stats.errors += 1;
                     continue;
@@ -128,6 +259,9 @@ pub fn backup(
                 }
                 Ok(_) => {}
             }
+            if let Some(observer) = observer.filter(|_| is_file) {
+                observer.file_completed(entry.apath(), entry.size().unwrap_or_default());
+            }
             if let Some(bytes) = entry.size() {
                 if bytes > 0 {
                     view.update(|model| model.scanned_file_bytes += bytes)
@@ -142,8 +276,147 @@ pub fn backup(
     Ok(stats)
 }
 
+/// Return the source entries to back up, in apath order.
+///
+/// Files outside the size limits are left out, with a message for each one.
+///
+/// If `options.since` is set, this first walks the whole tree to find which
+/// directories contain recently modified entries, because a directory is
+/// seen before its contents.
+fn source_entries(
+    source: &LiveTree,
+    options: &BackupOptions,
+) -> Result<Box<dyn Iterator<Item = LiveEntry>>> {
+    let larger_than = options.exclude_larger_than;
+    let smaller_than = options.exclude_smaller_than;
+    let entries = source
+        .iter_entries(Apath::root(), options.exclude.clone())?
+        .filter(
+            move |entry| match size_exclusion(entry, larger_than, smaller_than) {
+                Some(reason) => {
+                    ui::println(&format!("Skipped {}: {}", entry.apath(), reason));
+                    false
+                }
+                None => true,
+            },
+        );
+    let since = match options.since {
+        Some(since) => since.timestamp(),
+        None => return Ok(Box::new(entries)),
+    };
+    let mut keep_dirs: HashSet<String> = HashSet::new();
+    keep_dirs.insert("/".to_owned());
+    for entry in source
+        .iter_entries(Apath::root(), options.exclude.clone())?
+        .filter(|entry| {
+            entry.kind() != Kind::Dir
+                && entry.mtime().secs >= since
+                && size_exclusion(entry, larger_than, smaller_than).is_none()
+        })
+    {
+        let mut dir: &str = entry.apath();
+        while let Some(slash) = dir.rfind('/').filter(|&slash| slash > 0) {
+            dir = &dir[..slash];
+            if !keep_dirs.insert(dir.to_owned()) {
+                // Its parents are already there too.
+                break;
+            }
+        }
+    }
+    Ok(Box::new(entries.filter(move |entry| match entry.kind() {
+        Kind::Dir => keep_dirs.contains(&entry.apath()[..]),
+        _ => entry.mtime().secs >= since,
+    })))
+}
+
+/// If a file is outside the size limits, return why.
+fn size_exclusion(
+    entry: &LiveEntry,
+    larger_than: Option<u64>,
+    smaller_than: Option<u64>,
+) -> Option<String> {
+    let size = match (entry.kind(), entry.size()) {
+        (Kind::File, Some(size)) => size,
+        _ => return None,
+    };
+    match (larger_than, smaller_than) {
+        (Some(limit), _) if size > limit => Some(format!(
+            "{} bytes is larger than the limit of {} bytes",
+            size, limit
+        )),
+        (_, Some(limit)) if size < limit => Some(format!(
+            "{} bytes is smaller than the limit of {} bytes",
+            size, limit
+        )),
+        _ => None,
+    }
+}
+
+/// Parse a file size limit such as `1GB`, `500MiB`, or `4096`.
+pub fn parse_file_size(s: &str) -> std::result::Result<u64, String> {
+    crate::misc::parse_bytes(s)
+}
+
+/// Parse a `--since` time, either an RFC 3339 timestamp such as
+/// `2022-10-01T00:00:00Z`, or a duration before now such as `24h` or `7d`.
+pub fn parse_since(s: &str) -> std::result::Result<chrono::DateTime<chrono::Utc>, String> {
+    if let Ok(time) = chrono::DateTime::parse_from_rfc3339(s) {
+        return Ok(time.with_timezone(&chrono::Utc));
+    }
+    let duration = crate::prune::parse_duration(s)
+        .map_err(|_| format!("Invalid time {:?}: expected a timestamp like 2022-10-01T00:00:00Z or a duration like 24h", s))?;
+    Ok(chrono::Utc::now() - duration)
+}
+
+/// Compare the source to the last band, counting and printing the files that
+/// a backup would store.
+///
+/// `uncompressed_bytes` in the result is the total size of those files.
+fn backup_dry_run(
+    archive: &Archive,
+    source: &LiveTree,
+    options: &BackupOptions,
+) -> Result<BackupStats> {
+    let start = Instant::now();
+    let mut stats = BackupStats::default();
+    let mut basis_index = IterStitchedIndexHunks::new(archive, archive.last_band_id()?)
+        .iter_entries(Apath::root(), Exclude::nothing());
+    for entry in source_entries(source, options)? {
+        match entry.kind() {
+            Kind::Dir => stats.directories += 1,
+            Kind::Symlink => stats.symlinks += 1,
+            Kind::Fifo | Kind::BlockDevice | Kind::CharDevice => stats.special_files += 1,
+            Kind::Unknown => stats.unknown_kind += 1,
+            Kind::File => {
+                stats.files += 1;
+                let diff_kind = match basis_index.advance_to(entry.apath()) {
+                    Some(basis_entry)
+                        if !basis_entry.unrecoverable && entry.is_unchanged_from(&basis_entry) =>
+                    {
+                        stats.unmodified_files += 1;
+                        continue;
+                    }
+                    Some(_) => {
+                        stats.modified_files += 1;
+                        DiffKind::Changed
+                    }
+                    None => {
+                        stats.new_files += 1;
+                        DiffKind::New
+                    }
+                };
+                stats.uncompressed_bytes += entry.size().unwrap_or_default();
+                ui::println(&format!("{} {}", diff_kind.as_sigil(), entry.apath()));
+            }
+        }
+    }
+    stats.elapsed = start.elapsed();
+    Ok(stats)
+}
+
 /// Accepts files to write in the archive (in apath order.)
 struct BackupWriter {
+    archive: Archive,
     band: Band,
     index_builder: IndexWriter,
     stats: BackupStats,
@@ -154,29 +427,82 @@ struct BackupWriter {
     basis_index: crate::index::IndexEntryIter<crate::stitch::IterStitchedIndexHunks>,
 
     file_combiner: FileCombiner,
+
+    /// Read back stored blocks to check them.
+    verify: bool,
+
+    /// Sizes for content-defined chunking of large files, if enabled.
+    chunk_sizes: Option<ChunkSizes>,
+
+    /// Largest block to write, from the archive header.
+    block_size: usize,
+
+    /// Files up to this size are combined into shared blocks.
+    small_file_cap: u64,
+
+    /// Told about newly stored blocks.
+    observer: Option<Arc<dyn Observer>>,
+
+    /// True once the archive header has been marked with a version that
+    /// older versions of Conserve refuse to read.
+    extended_version: bool,
 }
 
 impl BackupWriter {
     /// Create a new BackupWriter.
     ///
-    /// This currently makes a new top-level band.
-    pub fn begin(archive: &Archive) -> Result<BackupWriter> {
+    /// This currently makes a new top-level band, recording that it's a
+    /// backup of `source`.
+    pub fn begin(
+        archive: &Archive,
+        source: &Path,
+        options: &BackupOptions,
+    ) -> Result<BackupWriter> {
         if gc_lock::GarbageCollectionLock::is_locked(archive)? {
             return Err(Error::GarbageCollectionLockHeld);
         }
         let basis_index = IterStitchedIndexHunks::new(archive, archive.last_band_id()?)
             .iter_entries(Apath::root(), Exclude::nothing());
 
+        let block_size = archive.block_size();
+        if let Some(chunk_sizes) = &options.chunk_sizes {
+            if chunk_sizes.max > block_size {
+                return Err(Error::ChunkSizeTooLarge {
+                    chunk_size: chunk_sizes.max,
+                    block_size,
+                });
+            }
+        }
+        // Record an absolute path, if possible, so that it's meaningful
+        // later on.
+        let source = source.canonicalize().unwrap_or_else(|_| source.to_owned());
         // Create the new band only after finding the basis band!
-        let band = Band::create(archive)?;
+        let band = Band::create_with_metadata(
+            archive,
+            options.label.as_deref(),
+            Some(&source.display().to_string()),
+        )?;
         let index_builder = band.index_builder();
         Ok(BackupWriter {
+            archive: archive.clone(),
             band,
             index_builder,
             block_dir: archive.block_dir().clone(),
             stats: BackupStats::default(),
             basis_index,
-            file_combiner: FileCombiner::new(archive.block_dir().clone()),
+            file_combiner: FileCombiner::new(
+                archive.block_dir().clone(),
+                options.verify,
+                TARGET_COMBINED_BLOCK_SIZE.min(block_size),
+                options.observer.clone(),
+            ),
+            verify: options.verify,
+            chunk_sizes: options.chunk_sizes,
+            block_size,
+            // Leave room for several files in each combined block.
+            small_file_cap: SMALL_FILE_CAP.min(block_size as u64 / 4),
+            observer: options.observer.clone(),
+            extended_version: false,
         })
     }
 
@@ -189,6 +515,15 @@ impl BackupWriter {
         })
     }
 
+    /// Store any combined blocks of small files that are ready.
+    ///
+    /// A failure here loses every file in the blocks, not just the one that
+    /// filled the last block, so it stops the backup rather than being
+    /// counted as an error for one file.
+    fn store_combined_blocks(&mut self) -> Result<()> {
+        self.file_combiner.store_full_blocks()
+    }
+
     /// Write out any pending data blocks, and then the pending index entries.
     fn flush_group(&mut self) -> Result<()> {
         let (stats, mut entries) = self.file_combiner.drain()?;
@@ -207,10 +542,11 @@ impl BackupWriter {
             Kind::Dir => self.copy_dir(entry),
             Kind::File => self.copy_file(entry, source),
             Kind::Symlink => self.copy_symlink(entry),
+            Kind::Fifo | Kind::BlockDevice | Kind::CharDevice => self.copy_special(entry),
             Kind::Unknown => {
                 self.stats.unknown_kind += 1;
-                // TODO: Perhaps eventually we could backup and restore pipes,
-                // sockets, etc. Or at least count them. For now, silently skip.
+                // TODO: Perhaps eventually we could backup and restore
+                // sockets. Or at least count them. For now, silently skip.
                 // https://github.com/sourcefrog/conserve/issues/82
                 Ok(None)
             }
@@ -234,9 +570,16 @@ impl BackupWriter {
         let apath = source_entry.apath();
         let result;
         if let Some(basis_entry) = self.basis_index.advance_to(apath) {
-            if source_entry.is_unchanged_from(&basis_entry) {
+            // If the stored copy was damaged and marked unrecoverable by a
+            // repair, store it again even if the source is unchanged.
+            if !basis_entry.unrecoverable && source_entry.is_unchanged_from(&basis_entry) {
                 self.stats.unmodified_files += 1;
-                self.index_builder.push_entry(basis_entry);
+                // Keep the stored content, but take other metadata such as
+                // permissions from the source, in case only they changed.
+                self.index_builder.push_entry(IndexEntry {
+                    addrs: basis_entry.addrs,
+                    ..IndexEntry::metadata_from(source_entry)
+                });
                 return Ok(Some(DiffKind::Unchanged));
             } else {
                 self.stats.modified_files += 1;
@@ -254,7 +597,7 @@ impl BackupWriter {
             self.stats.empty_files += 1;
             return Ok(result);
         }
-        if size <= SMALL_FILE_CAP {
+        if size <= self.small_file_cap {
             self.file_combiner
                 .push_file(source_entry, &mut read_source)?;
             return Ok(result);
@@ -262,7 +605,11 @@ impl BackupWriter {
         let addrs = store_file_content(
             apath,
             &mut read_source,
-            &mut self.block_dir,
+            &self.block_dir,
+            self.block_size,
+            self.chunk_sizes.as_ref(),
+            self.verify,
+            self.observer.as_deref(),
             &mut self.stats,
         )?;
         self.index_builder.push_entry(IndexEntry {
@@ -280,33 +627,83 @@ impl BackupWriter {
             .push_entry(IndexEntry::metadata_from(source_entry));
         Ok(None)
     }
+
+    /// Store a named pipe or device node, which has only metadata.
+    ///
+    /// Versions of Conserve before 0.6.17 can't read indexes containing these
+    /// kinds, so first mark the archive so that they won't try.
+    fn copy_special<E: Entry>(&mut self, source_entry: &E) -> Result<Option<DiffKind>> {
+        if !self.extended_version {
+            self.archive.require_extended_version()?;
+            self.extended_version = true;
+        }
+        self.stats.special_files += 1;
+        self.index_builder
+            .push_entry(IndexEntry::metadata_from(source_entry));
+        Ok(None)
+    }
 }
 
+/// Store the content of a large file, and return the addresses of its blocks.
+///
+/// Blocks are read one after another, and then up to one per thread in the
+/// rayon pool, and up to `MAX_PENDING_BLOCK_BYTES` in total, are hashed,
+/// compressed, and written in parallel.
 fn store_file_content(
     apath: &Apath,
     from_file: &mut dyn Read,
-    block_dir: &mut BlockDir,
+    block_dir: &BlockDir,
+    block_size: usize,
+    chunk_sizes: Option<&ChunkSizes>,
+    verify: bool,
+    observer: Option<&dyn Observer>,
     stats: &mut BackupStats,
 ) -> Result<Vec<Address>> {
+    let max_len = chunk_sizes.map_or(block_size, |sizes| sizes.max);
+    // Data read from the file but not yet stored.
     let mut buffer = Vec::new();
+    let mut read_buf = Vec::new();
     let mut addresses = Vec::<Address>::with_capacity(1);
+    let batch_size = rayon::current_num_threads();
+    // Blocks read but not yet stored, and their total length.
+    let mut pending: Vec<Vec<u8>> = Vec::with_capacity(batch_size);
+    let mut pending_bytes = 0;
     loop {
-        read_with_retries(&mut buffer, MAX_BLOCK_SIZE, from_file).map_err(|source| {
+        // Top up the buffer to a full block, so that when it's any shorter
+        // we're at the end of the file.
+        read_with_retries(&mut read_buf, max_len - buffer.len(), from_file).map_err(|source| {
             Error::StoreFile {
                 apath: apath.to_owned(),
                 source,
             }
         })?;
+        buffer.extend_from_slice(&read_buf);
         if buffer.is_empty() {
             break;
         }
-        let hash = block_dir.store_or_deduplicate(buffer.as_slice(), stats)?;
-        addresses.push(Address {
-            hash,
-            start: 0,
-            len: buffer.len() as u64,
-        });
+        let len = chunk_sizes.map_or(buffer.len(), |sizes| sizes.find_boundary(&buffer));
+        pending.push(buffer.drain(..len).collect());
+        pending_bytes += len;
+        if pending.len() >= batch_size || pending_bytes >= MAX_PENDING_BLOCK_BYTES {
+            pending_bytes = 0;
+            store_pending_blocks(
+                block_dir,
+                &mut pending,
+                verify,
+                observer,
+                stats,
+                &mut addresses,
+            )?;
+        }
     }
+    store_pending_blocks(
+        block_dir,
+        &mut pending,
+        verify,
+        observer,
+        stats,
+        &mut addresses,
+    )?;
     match addresses.len() {
         0 => stats.empty_files += 1,
         1 => stats.single_block_files += 1,
@@ -315,6 +712,87 @@ fn store_file_content(
     Ok(addresses)
 }
 
+/// Store the blocks in `pending`, appending their addresses in order, and
+/// leave it empty.
+fn store_pending_blocks(
+    block_dir: &BlockDir,
+    pending: &mut Vec<Vec<u8>>,
+    verify: bool,
+    observer: Option<&dyn Observer>,
+    stats: &mut BackupStats,
+    addresses: &mut Vec<Address>,
+) -> Result<()> {
+    if pending.is_empty() {
+        return Ok(());
+    }
+    let blocks: Vec<&[u8]> = pending.iter().map(Vec::as_slice).collect();
+    let hashes = store_blocks(block_dir, &blocks, verify, observer, stats)?;
+    addresses.extend(
+        hashes
+            .into_iter()
+            .zip(pending.drain(..))
+            .map(|(hash, data)| Address {
+                hash,
+                start: 0,
+                len: data.len() as u64,
+            }),
+    );
+    Ok(())
+}
+
+/// Store blocks, or find that they're already present, hashing, compressing,
+/// and writing them in parallel on the rayon thread pool. Returns their
+/// hashes in the same order as `blocks`.
+///
+/// If a block appears more than once, it's only written once. If storing any
+/// block fails, blocks that haven't yet started are abandoned and the error
+/// is returned.
+///
+/// If `verify` is true, read each block back and check its hash, returning
+/// `Error::BlockCorrupt` if it doesn't match.
+fn store_blocks(
+    block_dir: &BlockDir,
+    blocks: &[&[u8]],
+    verify: bool,
+    observer: Option<&dyn Observer>,
+    stats: &mut BackupStats,
+) -> Result<Vec<BlockHash>> {
+    let hashes: Vec<BlockHash> = blocks
+        .par_iter()
+        .map(|block_data| block_dir.hash_bytes(block_data))
+        .collect();
+    let mut seen: HashSet<&BlockHash> = HashSet::new();
+    let mut unique = Vec::with_capacity(blocks.len());
+    for (block_data, hash) in blocks.iter().zip(&hashes) {
+        if seen.insert(hash) {
+            unique.push((*block_data, hash));
+        } else {
+            stats.deduplicated_blocks += 1;
+            stats.deduplicated_bytes += block_data.len() as u64;
+        }
+    }
+    let block_stats = unique
+        .into_par_iter()
+        .map(|(block_data, hash)| {
+            let mut block_stats = BackupStats::default();
+            block_dir.store_hashed(block_data, hash, &mut block_stats)?;
+            if verify {
+                block_dir.get_block_content(hash)?;
+            }
+            if let Some(observer) = observer {
+                if block_stats.written_blocks > 0 {
+                    observer.block_stored(hash, block_data.len());
+                }
+            }
+            Ok(block_stats)
+        })
+        .collect::<Result<Vec<BackupStats>>>()?;
+    for block_stats in block_stats {
+        *stats += block_stats;
+    }
+    Ok(hashes)
+}
+
 /// Combines multiple small files into a single block.
 ///
 /// When the block is finished, and only then, this returns the index entries with the addresses
@@ -323,10 +801,18 @@ struct FileCombiner {
     /// Buffer of concatenated data from small files.
     buf: Vec<u8>,
     queue: Vec<QueuedFile>,
+    /// Combined blocks that are full, waiting to be stored together.
+    sealed: Vec<CombinedBlock>,
     /// Entries for files that have been written to the blockdir, and that have complete addresses.
     finished: Vec<IndexEntry>,
     stats: BackupStats,
     block_dir: BlockDir,
+    /// Read back stored blocks to check them.
+    verify: bool,
+    /// Write out the combined block once it's at least this big.
+    target_size: usize,
+    /// Told about newly stored blocks.
+    observer: Option<Arc<dyn Observer>>,
 }
 
 /// A file in the process of being written into a combined block.
@@ -343,12 +829,27 @@ struct QueuedFile {
     entry: IndexEntry,
 }
 
+/// A full combined block that hasn't been stored yet.
+struct CombinedBlock {
+    data: Vec<u8>,
+    files: Vec<QueuedFile>,
+}
+
 impl FileCombiner {
-    fn new(block_dir: BlockDir) -> FileCombiner {
+    fn new(
+        block_dir: BlockDir,
+        verify: bool,
+        target_size: usize,
+        observer: Option<Arc<dyn Observer>>,
+    ) -> FileCombiner {
         FileCombiner {
             block_dir,
+            verify,
+            target_size,
+            observer,
             buf: Vec::new(),
             queue: Vec::new(),
+            sealed: Vec::new(),
             finished: Vec::new(),
             stats: BackupStats::default(),
         }
@@ -360,37 +861,80 @@ impl FileCombiner {
         self.flush()?;
         debug_assert!(self.queue.is_empty());
         debug_assert!(self.buf.is_empty());
+        debug_assert!(self.sealed.is_empty());
         Ok((
             std::mem::take(&mut self.stats),
             std::mem::take(&mut self.finished),
         ))
     }
 
-    /// Write all the content from the combined block to a blockdir.
-    ///
-    /// Returns the fully populated entries for all files in this combined block.
+    /// Write all the content from the combined blocks to a blockdir, and
+    /// add the fully populated entries for their files to `finished`.
     ///
     /// After this call the FileCombiner is empty and can be reused for more files into a new
     /// block.
     fn flush(&mut self) -> Result<()> {
+        self.seal();
+        self.store_sealed()
+    }
+
+    /// Set aside the block being filled, to be stored later.
+    fn seal(&mut self) {
         if self.queue.is_empty() {
             debug_assert!(self.buf.is_empty());
+            return;
+        }
+        self.sealed.push(CombinedBlock {
+            data: std::mem::take(&mut self.buf),
+            files: std::mem::take(&mut self.queue),
+        });
+    }
+
+    /// Store the sealed blocks, if there are enough to use all the threads,
+    /// or enough data that it shouldn't be held in memory any longer.
+    fn store_full_blocks(&mut self) -> Result<()> {
+        let sealed_bytes: usize = self.sealed.iter().map(|block| block.data.len()).sum();
+        if self.sealed.len() >= rayon::current_num_threads()
+            || sealed_bytes >= MAX_PENDING_BLOCK_BYTES
+        {
+            self.store_sealed()
+        } else {
+            Ok(())
+        }
+    }
+
+    /// Store all the sealed blocks in parallel.
+    ///
+    /// They're removed only once they're all stored, so that if this fails,
+    /// their files are still queued.
+    fn store_sealed(&mut self) -> Result<()> {
+        if self.sealed.is_empty() {
             return Ok(());
         }
-        let hash = self
-            .block_dir
-            .store_or_deduplicate(&self.buf, &mut self.stats)?;
-        self.stats.combined_blocks += 1;
-        self.buf.clear();
-        self.finished
-            .extend(self.queue.drain(..).map(|qf| IndexEntry {
-                addrs: vec![Address {
-                    hash: hash.clone(),
-                    start: qf.start.try_into().unwrap(),
-                    len: qf.len.try_into().unwrap(),
-                }],
-                ..qf.entry
-            }));
+        let blocks: Vec<&[u8]> = self
+            .sealed
+            .iter()
+            .map(|block| block.data.as_slice())
+            .collect();
+        let hashes = store_blocks(
+            &self.block_dir,
+            &blocks,
+            self.verify,
+            self.observer.as_deref(),
+            &mut self.stats,
+        )?;
+        self.stats.combined_blocks += self.sealed.len();
+        for (block, hash) in self.sealed.drain(..).zip(hashes) {
+            self.finished
+                .extend(block.files.into_iter().map(|qf| IndexEntry {
+                    addrs: vec![Address {
+                        hash: hash.clone(),
+                        start: qf.start.try_into().unwrap(),
+                        len: qf.len.try_into().unwrap(),
+                    }],
+                    ..qf.entry
+                }));
+        }
         Ok(())
     }
 
@@ -432,10 +976,10 @@ impl FileCombiner {
             len,
             entry: index_entry,
         });
-        if self.buf.len() >= TARGET_COMBINED_BLOCK_SIZE {
-            self.flush()
-        } else {
-            Ok(())
+        // Full blocks are stored later, by `store_full_blocks`.
+        if self.buf.len() >= self.target_size {
+            self.seal();
         }
+        Ok(())
     }
 }
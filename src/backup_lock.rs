@@ -0,0 +1,181 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! A `BackupLock` stops two backups writing to the same archive at once.
+//!
+//! Each backup writes into a new band numbered one after the last existing
+//! band, so two concurrent backups could otherwise both choose the same band
+//! and interleave their index hunks.
+//!
+//! Like the [GarbageCollectionLock], the lock is a file in the archive
+//! directory, so it works on any transport. The file records the pid and
+//! start time of the process that took it, so that the user can tell
+//! whether it's stale. There's no way to check from here whether a process
+//! on some other machine is still alive, so stale locks are only removed
+//! when the user asks.
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+
+use crate::*;
+
+const BACKUP_LOCK: &str = "BACKUP_LOCK";
+
+/// The contents of the lock file.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BackupLockHolder {
+    pub pid: u32,
+    pub start_time: DateTime<Utc>,
+}
+
+/// Lock on an archive held while making a backup.
+///
+/// The lock is released when the object is dropped.
+#[derive(Debug)]
+pub struct BackupLock {
+    archive: Archive,
+}
+
+impl BackupLock {
+    /// Lock this archive for a backup.
+    ///
+    /// Returns `Err(Error::BackupLockHeld)` if another backup holds the lock.
+    ///
+    /// The lock file is created atomically, so if two backups start at the
+    /// same time only one of them gets the lock.
+    pub fn new(archive: &Archive) -> Result<BackupLock> {
+        let archive = archive.clone();
+        let holder = BackupLockHolder {
+            pid: std::process::id(),
+            start_time: Utc::now(),
+        };
+        let json = serde_json::to_string(&holder).map_err(|source| Error::SerializeJson {
+            path: BACKUP_LOCK.to_owned(),
+            source,
+        })?;
+        match archive
+            .transport()
+            .create_new_file(BACKUP_LOCK, (json + "\n").as_bytes())
+        {
+            Ok(()) => Ok(BackupLock { archive }),
+            Err(err) if err.kind() == std::io::ErrorKind::AlreadyExists => {
+                Err(Error::BackupLockHeld {
+                    holder: BackupLock::holder(&archive),
+                })
+            }
+            Err(err) => Err(err.into()),
+        }
+    }
+
+    /// Take a lock on an archive, breaking any existing backup lock.
+    ///
+    /// Use this only if you're confident that the process owning the lock
+    /// has terminated and the lock is stale.
+    pub fn break_lock(archive: &Archive) -> Result<BackupLock> {
+        if BackupLock::is_locked(archive)? {
+            archive.transport().remove_file(BACKUP_LOCK)?;
+        }
+        BackupLock::new(archive)
+    }
+
+    /// Returns true if the archive is currently locked by a backup.
+    pub fn is_locked(archive: &Archive) -> Result<bool> {
+        archive
+            .transport()
+            .is_file(BACKUP_LOCK)
+            .map_err(Error::from)
+    }
+
+    /// Describe the process holding the lock, if the lock file can be read.
+    pub fn holder(archive: &Archive) -> Option<BackupLockHolder> {
+        let bytes = archive.transport().read_file(BACKUP_LOCK).ok()?;
+        serde_json::from_slice(&bytes).ok()
+    }
+}
+
+impl Drop for BackupLock {
+    fn drop(&mut self) {
+        if let Err(err) = self.archive.transport().remove_file(BACKUP_LOCK) {
+            // Print directly to stderr, in case the UI structure is in a
+            // bad state during unwind.
+            eprintln!("Failed to delete BACKUP_LOCK: {:?}", err)
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::test_fixtures::{ScratchArchive, TreeFixture};
+
+    #[test]
+    fn lock_records_pid_and_is_released() {
+        let archive = ScratchArchive::new();
+        let lock = BackupLock::new(&archive).unwrap();
+        assert_eq!(
+            BackupLock::holder(&archive).unwrap().pid,
+            std::process::id()
+        );
+        drop(lock);
+        assert!(!BackupLock::is_locked(&archive).unwrap());
+    }
+
+    #[test]
+    fn concurrent_backup_denied() {
+        let archive = ScratchArchive::new();
+        let source = TreeFixture::new();
+        let _lock = BackupLock::new(&archive).unwrap();
+        let backup_result = backup(&archive, &source.live_tree(), &BackupOptions::default());
+        match backup_result {
+            Err(Error::BackupLockHeld {
+                holder: Some(BackupLockHolder { pid, .. }),
+            }) => assert_eq!(pid, std::process::id()),
+            other => panic!("unexpected result {:?}", other),
+        }
+        assert!(archive.list_band_ids().unwrap().is_empty());
+    }
+
+    #[test]
+    fn only_one_of_several_racing_backups_gets_the_lock() {
+        let scratch = ScratchArchive::new();
+        let threads: Vec<_> = (0..8)
+            .map(|_| {
+                let archive: Archive = (*scratch).clone();
+                std::thread::spawn(move || match BackupLock::new(&archive) {
+                    Ok(lock) => Some(lock),
+                    Err(Error::BackupLockHeld { .. }) => None,
+                    Err(err) => panic!("unexpected error {:?}", err),
+                })
+            })
+            .collect();
+        // Hold on to all the locks until every thread has tried.
+        let locks: Vec<BackupLock> = threads
+            .into_iter()
+            .filter_map(|thread| thread.join().unwrap())
+            .collect();
+        assert_eq!(locks.len(), 1);
+    }
+
+    #[test]
+    fn break_stale_lock() {
+        let archive = ScratchArchive::new();
+        let source = TreeFixture::new();
+        std::mem::forget(BackupLock::new(&archive).unwrap());
+        let options = BackupOptions {
+            break_lock: true,
+            ..BackupOptions::default()
+        };
+        backup(&archive, &source.live_tree(), &options).unwrap();
+        assert!(!BackupLock::is_locked(&archive).unwrap());
+    }
+}
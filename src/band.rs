@@ -44,6 +44,8 @@ pub enum BandSelectionPolicy {
     Latest,
     /// Open the band with the specified id.
     Specified(BandId),
+    /// Open the only band with this label.
+    Labelled(String),
 }
 
 fn band_version_requirement() -> semver::VersionReq {
@@ -76,6 +78,22 @@ struct Head {
     /// Semver string for the minimum Conserve version to read this band
     /// correctly.
     band_format_version: Option<String>,
+
+    /// Free-text label given by the user when the backup was made.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    label: Option<String>,
+
+    /// Name of the machine that wrote this band.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    hostname: Option<String>,
+
+    /// Version of Conserve that wrote this band.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    conserve_version: Option<String>,
+
+    /// The source directory that was backed up.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    source: Option<String>,
 }
 
 /// Format of the on-disk tail file.
@@ -103,6 +121,18 @@ pub struct Info {
 
     /// Number of hunks present in the index, if that is known.
     pub index_hunk_count: Option<u64>,
+
+    /// Label given to the band when it was created, if any.
+    pub label: Option<String>,
+
+    /// Name of the machine that wrote this band, if known.
+    pub hostname: Option<String>,
+
+    /// Version of Conserve that wrote this band, if known.
+    pub conserve_version: Option<String>,
+
+    /// The source directory that was backed up, if known.
+    pub source: Option<String>,
 }
 
 // TODO: Maybe merge Band with StoredTree and/or with the Index classes? The distinction seems
@@ -112,6 +142,18 @@ impl Band {
     ///
     /// The Band gets the next id after those that already exist.
     pub fn create(archive: &Archive) -> Result<Band> {
+        Band::create_with_metadata(archive, None, None)
+    }
+
+    /// Make a new band with an optional label, recording the source
+    /// directory it's a backup of.
+    ///
+    /// The hostname and Conserve version are also recorded in the band head.
+    pub fn create_with_metadata(
+        archive: &Archive,
+        label: Option<&str>,
+        source: Option<&str>,
+    ) -> Result<Band> {
         let band_id = archive
             .last_band_id()?
             .map_or_else(BandId::zero, |b| b.next_sibling());
@@ -123,6 +165,10 @@ impl Band {
         let head = Head {
             start_time: Utc::now().timestamp(),
             band_format_version: Some(BAND_FORMAT_VERSION.to_owned()),
+            label: label.map(str::to_owned),
+            hostname: gethostname::gethostname().into_string().ok(),
+            conserve_version: Some(crate::version().to_owned()),
+            source: source.map(str::to_owned),
         };
         write_json(&transport, BAND_HEAD_FILENAME, &head)?;
         Ok(Band {
@@ -188,6 +234,11 @@ impl Band {
         &self.band_id
     }
 
+    /// Return the label given to this band when it was created, if any.
+    pub fn label(&self) -> Option<&str> {
+        self.head.label.as_deref()
+    }
+
     pub fn index_builder(&self) -> IndexWriter {
         IndexWriter::new(self.transport.sub_transport(INDEX_DIR))
     }
@@ -212,6 +263,10 @@ impl Band {
                 .as_ref()
                 .map(|tail| Utc.timestamp(tail.end_time, 0)),
             index_hunk_count: tail_option.as_ref().and_then(|tail| tail.index_hunk_count),
+            label: self.head.label.clone(),
+            hostname: self.head.hostname.clone(),
+            conserve_version: self.head.conserve_version.clone(),
+            source: self.head.source.clone(),
         })
     }
 
@@ -16,6 +16,8 @@
 use std::fmt::{self, Write};
 use std::str::FromStr;
 
+use serde::{Serialize, Serializer};
+
 use crate::errors::Error;
 
 /// Identifier for a band within an archive, eg 'b0001' or 'b0001-0020'.
@@ -113,6 +115,13 @@ impl fmt::Display for BandId {
     }
 }
 
+/// Serialized as its string form, such as `"b0001"`.
+impl Serialize for BandId {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.collect_str(self)
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
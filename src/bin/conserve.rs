@@ -17,9 +17,12 @@ use std::io::{BufWriter, Write};
 use std::path::PathBuf;
 
 use clap::{Parser, StructOpt, Subcommand};
+use serde::Serialize;
 use tracing::trace;
 
 use conserve::backup::BackupOptions;
+use conserve::transport::retry::{RetryPolicy, RetryTransport};
+use conserve::transport::throttle::ThrottledTransport;
 use conserve::ReadTree;
 use conserve::RestoreOptions;
 use conserve::*;
@@ -42,6 +45,26 @@ struct Args {
     /// Show debug trace to stdout.
     #[clap(long, short = 'D', global = true)]
     debug: bool,
+
+    /// Number of threads for parallel work such as storing, checking, and
+    /// deleting blocks; by default, one per CPU.
+    #[clap(long, short = 'j', global = true)]
+    jobs: Option<usize>,
+
+    /// Number of times to retry archive operations that fail with transient
+    /// errors, such as timeouts.
+    #[clap(long, global = true, default_value = "0")]
+    retries: u32,
+
+    /// Time to wait before the first retry, such as `500ms` or `2s`; it
+    /// doubles after each further failure.
+    #[clap(long, global = true, default_value = "1s", parse(try_from_str = conserve::transport::retry::parse_retry_wait))]
+    retry_wait: std::time::Duration,
+
+    /// File holding the key that signs the manifest of a signed archive.
+    /// Otherwise, the key is derived from $CONSERVE_PASSPHRASE.
+    #[clap(long, global = true)]
+    key_file: Option<PathBuf>,
 }
 
 #[derive(Subcommand, Debug)]
@@ -61,6 +84,63 @@ enum Command {
         exclude_from: Vec<String>,
         #[clap(long)]
         no_stats: bool,
+        /// Don't write anything, just list the files that would be stored.
+        #[clap(long)]
+        dry_run: bool,
+        /// Limit the rate of writing to the archive, such as `500KB` or `2MB` per second. 0 means unlimited.
+        #[clap(long, parse(try_from_str = conserve::transport::throttle::parse_bytes_per_second))]
+        bwlimit: Option<u64>,
+        /// Write backup statistics as JSON to this file.
+        #[clap(long)]
+        stats_json: Option<PathBuf>,
+        /// Read back each block after it's written, and check its hash.
+        #[clap(long)]
+        verify: bool,
+        /// Break a lock left behind by a previous interrupted backup, and then back up.
+        #[clap(long)]
+        break_lock: bool,
+        /// Split large files into blocks of about this size, such as `256KB`, at boundaries chosen by their content.
+        #[clap(long, parse(try_from_str = conserve::chunker::parse_average_chunk_size))]
+        chunk_avg_size: Option<ChunkSizes>,
+        /// Only back up files modified since this time, such as `2022-10-01T00:00:00Z` or `24h`.
+        #[clap(long, parse(try_from_str = conserve::backup::parse_since))]
+        since: Option<chrono::DateTime<chrono::Utc>>,
+        /// Don't back up files larger than this, such as `1GB`. KB, MB, and GB are decimal; KiB, MiB, and GiB are binary.
+        #[clap(long, parse(try_from_str = conserve::backup::parse_file_size))]
+        exclude_larger_than: Option<u64>,
+        /// Don't back up files smaller than this, such as `1KB`.
+        #[clap(long, parse(try_from_str = conserve::backup::parse_file_size))]
+        exclude_smaller_than: Option<u64>,
+        /// Don't descend into directories on other filesystems.
+        #[clap(long, short = 'x')]
+        one_file_system: bool,
+        /// Label the new backup, so it can be selected later with `-b LABEL`.
+        #[clap(long)]
+        label: Option<String>,
+    },
+
+    /// Write the content of a stored file to stdout.
+    Cat {
+        archive: String,
+        /// Path of the file within the backup, such as `/src/main.rs`.
+        path: Apath,
+        #[clap(long, short)]
+        backup: Option<String>,
+    },
+
+    /// Check that source directories can be read, without backing them up.
+    CheckSource {
+        #[clap(required = true)]
+        sources: Vec<PathBuf>,
+        #[clap(long, short, number_of_values = 1)]
+        exclude: Vec<String>,
+        #[clap(long, short = 'E', number_of_values = 1)]
+        exclude_from: Vec<String>,
+        /// Don't descend into directories on other filesystems.
+        #[clap(long, short = 'x')]
+        one_file_system: bool,
+        #[clap(long)]
+        no_stats: bool,
     },
 
     #[clap(subcommand)]
@@ -94,19 +174,50 @@ enum Command {
         archive: String,
         source: PathBuf,
         #[clap(long, short)]
-        backup: Option<BandId>,
+        backup: Option<String>,
         #[clap(long, short, number_of_values = 1)]
         exclude: Vec<String>,
         #[clap(long, short = 'E', number_of_values = 1)]
         exclude_from: Vec<String>,
         #[clap(long)]
         include_unchanged: bool,
+        /// Don't descend into directories on other filesystems.
+        #[clap(long, short = 'x')]
+        one_file_system: bool,
+    },
+
+    /// Write a stored tree as a tar file.
+    ExportTar {
+        archive: String,
+        /// File to write the tar to, or `-` for stdout.
+        output: PathBuf,
+        #[clap(long, short)]
+        backup: Option<String>,
+        /// Compress the tar file with gzip.
+        #[clap(long, short = 'z')]
+        gzip: bool,
+        #[clap(long, short, number_of_values = 1)]
+        exclude: Vec<String>,
+        #[clap(long, short = 'E', number_of_values = 1)]
+        exclude_from: Vec<String>,
+        #[clap(long = "only", short = 'i', number_of_values = 1)]
+        only_subtree: Option<Apath>,
     },
 
     /// Create a new archive.
     Init {
         /// Path for new archive.
         archive: String,
+        /// Split files into blocks of at most this size, such as `4MiB`, in every backup to this archive.
+        #[clap(long, parse(try_from_str = conserve::archive::parse_block_size))]
+        block_size: Option<usize>,
+        /// Hash algorithm used to name blocks: blake2b, sha256, or blake3.
+        #[clap(long, default_value = "blake2b")]
+        hash: HashAlgorithm,
+        /// Keep a signed manifest of the archive, so that any change made
+        /// outside Conserve can be detected by `verify-manifest`.
+        #[clap(long)]
+        sign: bool,
     },
 
     /// Delete blocks unreferenced by any index.
@@ -125,6 +236,16 @@ enum Command {
         no_stats: bool,
     },
 
+    /// Show when, where, and how a backup version was made.
+    Info {
+        archive: String,
+        /// Version to describe, by id or label; by default the most recent.
+        backup: Option<String>,
+        /// Show times in UTC.
+        #[clap(long)]
+        utc: bool,
+    },
+
     /// List files in a stored tree or source directory, with exclusions.
     Ls {
         #[clap(flatten)]
@@ -134,16 +255,80 @@ enum Command {
         exclude: Vec<String>,
         #[clap(long, short = 'E', number_of_values = 1)]
         exclude_from: Vec<String>,
+        /// List only this subtree.
+        #[clap(long = "only", short = 'i', number_of_values = 1)]
+        only_subtree: Option<Apath>,
+        /// Show the kind, size, and modification time of each entry.
+        #[clap(long = "long", short = 'l')]
+        long_listing: bool,
+        /// Show times in UTC rather than the local timezone.
+        #[clap(long)]
+        utc: bool,
+        /// Only descend this many levels below the listed directory.
+        #[clap(long)]
+        depth: Option<usize>,
+    },
+
+    /// Mount a backup as a read-only filesystem, until interrupted.
+    #[cfg(feature = "fuse")]
+    Mount {
+        archive: String,
+        /// Directory to mount the backup on.
+        mountpoint: PathBuf,
+        #[clap(long, short)]
+        backup: Option<String>,
+    },
+
+    /// Delete old backups that aren't kept by a retention policy, and the
+    /// blocks that only they reference.
+    ///
+    /// A backup is kept if it matches any of the rules. Incomplete backups are
+    /// never deleted.
+    Prune {
+        /// Archive to prune.
+        archive: String,
+        /// Keep this many of the most recent complete backups.
+        #[clap(long)]
+        keep_last: Option<usize>,
+        /// Keep complete backups started within this time, such as `12h`, `30d`, or `8w`.
+        #[clap(long, parse(try_from_str = conserve::prune::parse_duration))]
+        keep_within: Option<chrono::Duration>,
+        /// Don't actually delete, just list what would be deleted.
+        #[clap(long)]
+        dry_run: bool,
+        /// Break a lock left behind by a previous interrupted gc operation, and then prune.
+        #[clap(long)]
+        break_lock: bool,
+        #[clap(long)]
+        no_stats: bool,
     },
 
     /// Copy a stored tree to a restore directory.
     Restore {
         archive: String,
+        /// Directory to restore into, or `-` to write the single file selected by `--only` to stdout.
         destination: PathBuf,
+        /// Backup to restore, either a version such as `b1` or a label given to it by `backup --label`.
         #[clap(long, short)]
-        backup: Option<BandId>,
-        #[clap(long, short)]
+        backup: Option<String>,
+        /// Restore into a non-empty directory, replacing existing files.
+        #[clap(long, short, alias = "overwrite")]
         force_overwrite: bool,
+        /// Restore into a non-empty directory, leaving existing files alone.
+        #[clap(long)]
+        skip_existing: bool,
+        /// Restore into a non-empty directory, replacing only existing files that are older than the backup.
+        #[clap(long, conflicts_with_all = &["force-overwrite", "skip-existing"])]
+        merge: bool,
+        /// Read back each restored file and check that it matches the backup.
+        #[clap(long)]
+        verify: bool,
+        /// Leave holes in restored files where they contain runs of zeros.
+        #[clap(long)]
+        sparse: bool,
+        /// Convert file names to this Unicode normalization form: nfc, nfd, or none.
+        #[clap(long, default_value = "none")]
+        normalize: Normalization,
         #[clap(long, short)]
         verbose: bool,
         #[clap(long, short, number_of_values = 1)]
@@ -154,8 +339,15 @@ enum Command {
         only_subtree: Option<Apath>,
         #[clap(long)]
         no_stats: bool,
+        /// Don't try to restore the owner and group of files.
+        #[clap(long)]
+        no_owner: bool,
     },
 
+    /// Check that backup and restore work on this machine, using temporary
+    /// directories.
+    Selftest,
+
     /// Show the total size of files in a stored tree or source directory, with exclusions.
     Size {
         #[clap(flatten)]
@@ -171,6 +363,15 @@ enum Command {
         exclude_from: Vec<String>,
     },
 
+    /// Summarize the versions and storage in an archive, without checking
+    /// block contents.
+    Stats {
+        archive: String,
+        /// Write the summary as JSON.
+        #[clap(long)]
+        json: bool,
+    },
+
     /// Check that an archive is internally consistent.
     Validate {
         /// Path of the archive to check.
@@ -181,6 +382,19 @@ enum Command {
         quick: bool,
         #[clap(long)]
         no_stats: bool,
+        /// Write a report as JSON to stdout, and other messages to stderr.
+        #[clap(long)]
+        json: bool,
+        /// Move damaged blocks into quarantine, and mark files that use them as unrecoverable, so that they're skipped by restore.
+        #[clap(long)]
+        repair: bool,
+    },
+
+    /// Check a signed archive's manifest, and that the archive contains
+    /// exactly what it lists.
+    VerifyManifest {
+        /// Path of the archive to check.
+        archive: String,
     },
 
     /// List backup versions in an archive.
@@ -198,6 +412,12 @@ enum Command {
         /// Show times in UTC.
         #[clap(long)]
         utc: bool,
+        /// Show the host, source directory, and Conserve version of each backup.
+        #[clap(long, short, conflicts_with = "short")]
+        verbose: bool,
+        /// Write a JSON list of versions, including the number of blocks each one shares with the others.
+        #[clap(long, conflicts_with_all = &["short", "sizes", "verbose"])]
+        json: bool,
     },
 }
 
@@ -216,7 +436,7 @@ struct StoredTreeOrSource {
     source: Option<PathBuf>,
 
     #[clap(long, short, conflicts_with = "source")]
-    backup: Option<BandId>,
+    backup: Option<String>,
 }
 
 /// Show debugging information.
@@ -229,7 +449,7 @@ enum Debug {
 
         /// Backup version number.
         #[clap(long, short)]
-        backup: Option<BandId>,
+        backup: Option<String>,
     },
 
     /// List all blocks.
@@ -242,14 +462,33 @@ enum Debug {
     Unreferenced { archive: String },
 }
 
+#[derive(Clone, Copy)]
 enum ExitCode {
-    Ok = 0,
-    Failed = 1,
-    PartialCorruption = 2,
+    Ok,
+    Failed,
+    PartialCorruption,
+    /// The tree differs from the backup, as reported by `diff`.
+    Differences,
+    /// `diff` couldn't compare the trees.
+    DiffFailed,
+}
+
+impl ExitCode {
+    fn code(self) -> i32 {
+        match self {
+            ExitCode::Ok => 0,
+            ExitCode::Failed => 1,
+            ExitCode::PartialCorruption => 2,
+            // Like diff(1), use 1 for differences and 2 for trouble, so that
+            // scripts can tell them apart.
+            ExitCode::Differences => 1,
+            ExitCode::DiffFailed => 2,
+        }
+    }
 }
 
 impl Command {
-    fn run(&self) -> Result<ExitCode> {
+    fn run(&self, retry: &RetryPolicy, key_file: &Option<PathBuf>) -> Result<ExitCode> {
         let mut stdout = std::io::stdout();
         match self {
             Command::Backup {
@@ -259,22 +498,108 @@ impl Command {
                 exclude,
                 exclude_from,
                 no_stats,
+                dry_run,
+                bwlimit,
+                stats_json,
+                verify,
+                break_lock,
+                chunk_avg_size,
+                since,
+                exclude_larger_than,
+                exclude_smaller_than,
+                one_file_system,
+                label,
             } => {
-                let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?.build()?;
-                let source = &LiveTree::open(source)?;
+                let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?
+                    .add_source_ignore_file(source)?
+                    .build()?;
+                let source = &LiveTree::open(source)?
+                    .with_one_file_system(*one_file_system)
+                    .with_print_cache_dirs(*verbose);
                 let options = BackupOptions {
                     print_filenames: *verbose,
                     exclude,
+                    dry_run: *dry_run,
+                    verify: *verify,
+                    break_lock: *break_lock,
+                    chunk_sizes: *chunk_avg_size,
+                    since: *since,
+                    exclude_larger_than: *exclude_larger_than,
+                    exclude_smaller_than: *exclude_smaller_than,
+                    label: label.clone(),
                     ..Default::default()
                 };
-                let stats = backup(&Archive::open(open_transport(archive)?)?, source, &options)?;
-                if !no_stats {
+                let mut transport = open_archive_transport(archive, retry)?;
+                if let Some(bytes_per_second) = bwlimit.filter(|&rate| rate > 0) {
+                    transport = Box::new(ThrottledTransport::new(transport, bytes_per_second));
+                }
+                let archive = Archive::open(transport)?;
+                let options = BackupOptions {
+                    manifest_key: signing_key(&archive, key_file)?,
+                    ..options
+                };
+                let stats = backup(&archive, source, &options)?;
+                if *dry_run {
+                    if !no_stats {
+                        ui::println(&format!(
+                            "Backup dry run: would store {} files, {}.",
+                            stats.new_files + stats.modified_files,
+                            bytes_to_human_mb(stats.uncompressed_bytes)
+                        ));
+                    }
+                } else if !no_stats {
                     ui::println(&format!("Backup complete.\n{}", stats));
                 }
+                if let Some(stats_json) = stats_json {
+                    let json = serde_json::to_string_pretty(&stats).map_err(|source| {
+                        Error::SerializeJson {
+                            path: stats_json.display().to_string(),
+                            source,
+                        }
+                    })?;
+                    std::fs::write(stats_json, json + "\n")?;
+                }
+            }
+            Command::Cat {
+                archive,
+                path,
+                backup,
+            } => {
+                let st = stored_tree_from_opt(archive, backup, retry)?;
+                std::io::copy(&mut st.open_file(path)?, &mut stdout)?;
+            }
+            Command::CheckSource {
+                sources,
+                exclude,
+                exclude_from,
+                one_file_system,
+                no_stats,
+            } => {
+                let mut unreadable = false;
+                for source in sources {
+                    let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?
+                        .add_source_ignore_file(source)?
+                        .build()?;
+                    let tree = LiveTree::open(source)?.with_one_file_system(*one_file_system);
+                    match check_source(&tree, exclude) {
+                        Ok(stats) => {
+                            if !no_stats {
+                                ui::println(&format!("Checked {:?}:\n{}", source, stats));
+                            }
+                        }
+                        Err(err) => {
+                            ui::show_error(&err);
+                            unreadable = true;
+                        }
+                    }
+                }
+                if unreadable {
+                    return Ok(ExitCode::Failed);
+                }
             }
             Command::Debug(Debug::Blocks { archive }) => {
                 let mut bw = BufWriter::new(stdout);
-                for hash in Archive::open(open_transport(archive)?)?
+                for hash in Archive::open(open_archive_transport(archive, retry)?)?
                     .block_dir()
                     .block_names()?
                 {
@@ -282,19 +607,21 @@ impl Command {
                 }
             }
             Command::Debug(Debug::Index { archive, backup }) => {
-                let st = stored_tree_from_opt(archive, backup)?;
+                let st = stored_tree_from_opt(archive, backup, retry)?;
                 show::show_index_json(st.band(), &mut stdout)?;
             }
             Command::Debug(Debug::Referenced { archive }) => {
                 let mut bw = BufWriter::new(stdout);
-                let archive = Archive::open(open_transport(archive)?)?;
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
                 for hash in archive.referenced_blocks(&archive.list_band_ids()?)? {
                     writeln!(bw, "{}", hash)?;
                 }
             }
             Command::Debug(Debug::Unreferenced { archive }) => {
                 let mut bw = BufWriter::new(stdout);
-                for hash in Archive::open(open_transport(archive)?)?.unreferenced_blocks()? {
+                for hash in
+                    Archive::open(open_archive_transport(archive, retry)?)?.unreferenced_blocks()?
+                {
                     writeln!(bw, "{}", hash)?;
                 }
             }
@@ -305,13 +632,18 @@ impl Command {
                 break_lock,
                 no_stats,
             } => {
-                let stats = Archive::open(open_transport(archive)?)?.delete_bands(
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                let key = signing_key(&archive, key_file)?;
+                let stats = archive.delete_bands(
                     backup,
                     &DeleteOptions {
                         dry_run: *dry_run,
                         break_lock: *break_lock,
                     },
                 )?;
+                if !dry_run {
+                    update_manifest(&archive, &key)?;
+                }
                 if !no_stats {
                     ui::println(&format!("{}", stats));
                 }
@@ -323,15 +655,50 @@ impl Command {
                 exclude,
                 exclude_from,
                 include_unchanged,
+                one_file_system,
             } => {
-                let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?.build()?;
-                let st = stored_tree_from_opt(archive, backup)?;
-                let lt = LiveTree::open(source)?;
+                let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?
+                    .add_source_ignore_file(source)?
+                    .build()?;
+                let st = stored_tree_from_opt(archive, backup, retry)?;
+                let lt = LiveTree::open(source)?.with_one_file_system(*one_file_system);
                 let options = DiffOptions {
                     exclude,
                     include_unchanged: *include_unchanged,
                 };
-                show_diff(diff(&st, &lt, &options)?, &mut stdout)?;
+                let mut differences = false;
+                show_diff(
+                    diff(&st, &lt, &options)?
+                        .inspect(|de| differences |= de.kind != DiffKind::Unchanged),
+                    &mut stdout,
+                )?;
+                if differences {
+                    return Ok(ExitCode::Differences);
+                }
+            }
+            Command::ExportTar {
+                archive,
+                output,
+                backup,
+                gzip,
+                exclude,
+                exclude_from,
+                only_subtree,
+            } => {
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                let options = ExportTarOptions {
+                    exclude: ExcludeBuilder::from_args(exclude, exclude_from)?.build()?,
+                    only_subtree: only_subtree.clone(),
+                    band_selection: band_selection_policy_from_opt(backup),
+                    gzip: *gzip,
+                };
+                if output.as_os_str() == "-" {
+                    export_tar(&archive, &mut stdout, &options)?;
+                } else {
+                    let mut file = BufWriter::new(std::fs::File::create(output)?);
+                    export_tar(&archive, &mut file, &options)?;
+                    file.flush()?;
+                }
             }
             Command::Gc {
                 archive,
@@ -339,7 +706,8 @@ impl Command {
                 break_lock,
                 no_stats,
             } => {
-                let archive = Archive::open(open_transport(archive)?)?;
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                let key = signing_key(&archive, key_file)?;
                 let stats = archive.delete_bands(
                     &[],
                     &DeleteOptions {
@@ -347,33 +715,127 @@ impl Command {
                         break_lock: *break_lock,
                     },
                 )?;
+                if !dry_run {
+                    update_manifest(&archive, &key)?;
+                }
                 if !no_stats {
                     ui::println(&format!("{}", stats));
                 }
             }
-            Command::Init { archive } => {
-                Archive::create(open_transport(archive)?)?;
+            Command::Init {
+                archive,
+                block_size,
+                hash,
+                sign,
+            } => {
+                // Check the key is available before making the archive.
+                if *sign {
+                    match key_file {
+                        Some(key_file) => drop(ManifestKey::from_file(key_file)?),
+                        None if passphrase().is_none() => return Err(Error::ManifestKeyRequired),
+                        None => (),
+                    }
+                }
+                let new_archive = Archive::create_with_options(
+                    open_archive_transport(archive, retry)?,
+                    &ArchiveOptions {
+                        block_size: *block_size,
+                        hash_algorithm: *hash,
+                        signed: *sign,
+                    },
+                )?;
+                update_manifest(&new_archive, &signing_key(&new_archive, key_file)?)?;
                 ui::println(&format!("Created new archive in {:?}", &archive));
             }
+            Command::Info {
+                archive,
+                backup,
+                utc,
+            } => {
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                let band_id = archive.resolve_band_id(band_selection_policy_from_opt(backup))?;
+                show_band_info(&Band::open(&archive, &band_id)?, *utc, &mut stdout)?;
+            }
             Command::Ls {
                 stos,
                 exclude,
                 exclude_from,
+                only_subtree,
+                long_listing,
+                utc,
+                depth,
             } => {
-                let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?.build()?;
+                let mut exclude_builder = ExcludeBuilder::from_args(exclude, exclude_from)?;
+                // Show the source files that a backup would include.
+                if let Some(source) = &stos.source {
+                    exclude_builder.add_source_ignore_file(source)?;
+                }
+                let exclude = exclude_builder.build()?;
+                let subtree = only_subtree.clone().unwrap_or_else(Apath::root);
+                let max_depth = depth.map(|depth| subtree.depth() + depth);
                 if let Some(archive) = &stos.archive {
-                    // TODO: Option for subtree.
-                    show::show_entry_names(
-                        stored_tree_from_opt(archive, &stos.backup)?
-                            .iter_entries(Apath::root(), exclude)?,
-                        &mut stdout,
-                    )?;
+                    let entries = stored_tree_from_opt(archive, &stos.backup, retry)?
+                        .iter_entries(subtree, exclude)?
+                        .filter(|entry| within_depth(entry, max_depth));
+                    if *long_listing {
+                        show::show_entry_details(entries, *utc, &mut stdout)?;
+                    } else {
+                        show::show_entry_names(entries, &mut stdout)?;
+                    }
                 } else {
-                    show::show_entry_names(
-                        LiveTree::open(stos.source.clone().unwrap())?
-                            .iter_entries(Apath::root(), exclude)?,
-                        &mut stdout,
-                    )?;
+                    let entries = LiveTree::open(stos.source.clone().unwrap())?
+                        .iter_entries(subtree, exclude)?
+                        .filter(|entry| within_depth(entry, max_depth));
+                    if *long_listing {
+                        show::show_entry_details(entries, *utc, &mut stdout)?;
+                    } else {
+                        show::show_entry_names(entries, &mut stdout)?;
+                    }
+                }
+            }
+            #[cfg(feature = "fuse")]
+            Command::Mount {
+                archive,
+                mountpoint,
+                backup,
+            } => {
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                conserve::mount(&archive, mountpoint, band_selection_policy_from_opt(backup))?;
+            }
+            Command::Prune {
+                archive,
+                keep_last,
+                keep_within,
+                dry_run,
+                break_lock,
+                no_stats,
+            } => {
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                let key = signing_key(&archive, key_file)?;
+                let policy = RetentionPolicy {
+                    keep_last: *keep_last,
+                    keep_within: *keep_within,
+                };
+                let prune_band_ids = bands_to_prune(&archive, &policy)?;
+                let stats = archive.delete_bands(
+                    &prune_band_ids,
+                    &DeleteOptions {
+                        dry_run: *dry_run,
+                        break_lock: *break_lock,
+                    },
+                )?;
+                for band_id in &prune_band_ids {
+                    if *dry_run {
+                        ui::println(&format!("Would delete {}", band_id));
+                    } else {
+                        ui::println(&format!("Deleted {}", band_id));
+                    }
+                }
+                if !dry_run {
+                    update_manifest(&archive, &key)?;
+                }
+                if !no_stats {
+                    ui::println(&format!("{}", stats));
                 }
             }
             Command::Restore {
@@ -382,13 +844,19 @@ impl Command {
                 backup,
                 verbose,
                 force_overwrite,
+                skip_existing,
+                merge,
+                verify,
+                sparse,
+                normalize,
                 exclude,
                 exclude_from,
                 only_subtree,
                 no_stats,
+                no_owner,
             } => {
                 let band_selection = band_selection_policy_from_opt(backup);
-                let archive = Archive::open(open_transport(archive)?)?;
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
                 let exclude = ExcludeBuilder::from_args(exclude, exclude_from)?.build()?;
                 let options = RestoreOptions {
                     print_filenames: *verbose,
@@ -396,13 +864,45 @@ impl Command {
                     only_subtree: only_subtree.clone(),
                     band_selection,
                     overwrite: *force_overwrite,
+                    skip_existing: *skip_existing,
+                    merge: *merge,
+                    no_owner: *no_owner,
+                    verify: *verify,
+                    sparse: *sparse,
+                    normalize: *normalize,
+                    observer: None,
                 };
 
+                if destination.as_os_str() == "-" {
+                    ui::messages_to_stderr(true);
+                    restore_to_writer(&archive, &mut stdout, &options)?;
+                    return Ok(ExitCode::Ok);
+                }
                 let stats = restore(&archive, destination, &options)?;
                 if !no_stats {
                     ui::println(&format!("Restore complete.\n{}", stats));
                 }
+                if *merge && !no_stats {
+                    ui::println(&format!(
+                        "Merged: kept {} existing entries at least as new as the backup, replaced {} older ones.",
+                        stats.kept_newer, stats.overwritten
+                    ));
+                }
+                if *verify {
+                    if stats.verify_failures > 0 {
+                        ui::problem(&format!(
+                            "Verification failed for {} restored files",
+                            stats.verify_failures
+                        ));
+                        return Ok(ExitCode::Failed);
+                    }
+                    ui::println(&format!(
+                        "Verified {} restored files.",
+                        stats.verified_files
+                    ));
+                }
             }
+            Command::Selftest => selftest()?,
             Command::Size {
                 stos,
                 bytes,
@@ -411,7 +911,7 @@ impl Command {
             } => {
                 let excludes = ExcludeBuilder::from_args(exclude, exclude_from)?.build()?;
                 let size = if let Some(archive) = &stos.archive {
-                    stored_tree_from_opt(archive, &stos.backup)?
+                    stored_tree_from_opt(archive, &stos.backup, retry)?
                         .size(excludes)?
                         .file_bytes
                 } else {
@@ -425,59 +925,188 @@ impl Command {
                     ui::println(&conserve::bytes_to_human_mb(size));
                 }
             }
+            Command::Stats { archive, json } => {
+                let stats = Archive::open(open_archive_transport(archive, retry)?)?.stats()?;
+                if *json {
+                    let json = serde_json::to_string_pretty(&stats).map_err(|source| {
+                        Error::SerializeJson {
+                            path: "archive stats".to_owned(),
+                            source,
+                        }
+                    })?;
+                    println!("{}", json);
+                } else {
+                    ui::println(&format!("{}", stats));
+                }
+            }
             Command::Validate {
                 archive,
                 quick,
                 no_stats,
+                json,
+                repair,
             } => {
                 let options = ValidateOptions {
                     skip_block_hashes: *quick,
+                    repair: *repair,
                 };
-                let stats = Archive::open(open_transport(archive)?)?.validate(&options)?;
-                if !no_stats {
-                    println!("{}", stats);
+                if *json {
+                    ui::messages_to_stderr(true);
+                }
+                let archive_obj = Archive::open(open_archive_transport(archive, retry)?)?;
+                let key = if *repair {
+                    signing_key(&archive_obj, key_file)?
+                } else {
+                    None
+                };
+                let report = archive_obj.validate_report(&options)?;
+                if *repair {
+                    update_manifest(&archive_obj, &key)?;
+                }
+                if *json {
+                    let json = serde_json::to_string_pretty(&ValidateJson {
+                        archive,
+                        report: &report,
+                    })
+                    .map_err(|source| Error::SerializeJson {
+                        path: "validate report".to_owned(),
+                        source,
+                    })?;
+                    println!("{}", json);
+                } else if !no_stats {
+                    println!("{}", report.stats);
                 }
-                if stats.has_problems() {
+                if !report.ok {
                     ui::problem("Archive has some problems.");
                     return Ok(ExitCode::PartialCorruption);
                 } else {
                     ui::println("Archive is OK.");
                 }
             }
+            Command::VerifyManifest { archive } => {
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
+                let key = manifest_key(&archive, key_file)?;
+                let report = verify_manifest(&archive, &key)?;
+                if report.has_problems() {
+                    ui::problem("Archive doesn't match its manifest.");
+                    return Ok(ExitCode::PartialCorruption);
+                } else {
+                    ui::println(&format!(
+                        "Archive matches its manifest: {} files and {} blocks.",
+                        report.files, report.blocks
+                    ));
+                }
+            }
             Command::Versions {
                 archive,
                 short,
                 newest,
                 sizes,
                 utc,
+                verbose,
+                json,
             } => {
                 ui::enable_progress(false);
-                let archive = Archive::open(open_transport(archive)?)?;
+                let archive = Archive::open(open_archive_transport(archive, retry)?)?;
                 let options = ShowVersionsOptions {
                     newest_first: *newest,
                     tree_size: *sizes,
                     utc: *utc,
                     start_time: !*short,
                     backup_duration: !*short,
+                    origin: *verbose,
                 };
-                conserve::show_versions(&archive, &options, &mut stdout)?;
+                if *json {
+                    conserve::show_versions_json(&archive, &options, &mut stdout)?;
+                } else {
+                    conserve::show_versions(&archive, &options, &mut stdout)?;
+                }
             }
         }
         Ok(ExitCode::Ok)
     }
 }
 
-fn stored_tree_from_opt(archive_location: &str, backup: &Option<BandId>) -> Result<StoredTree> {
-    let archive = Archive::open(open_transport(archive_location)?)?;
+/// The validate report as JSON, along with the archive it's about.
+#[derive(Serialize)]
+struct ValidateJson<'a> {
+    archive: &'a str,
+    #[serde(flatten)]
+    report: &'a ValidateReport,
+}
+
+/// Open a transport to an archive, with retries if they're enabled.
+fn open_archive_transport(location: &str, retry: &RetryPolicy) -> Result<Box<dyn Transport>> {
+    let transport = open_transport(location)?;
+    if retry.retries > 0 {
+        Ok(Box::new(RetryTransport::new(transport, *retry)))
+    } else {
+        Ok(transport)
+    }
+}
+
+fn stored_tree_from_opt(
+    archive_location: &str,
+    backup: &Option<String>,
+    retry: &RetryPolicy,
+) -> Result<StoredTree> {
+    let archive = Archive::open(open_archive_transport(archive_location, retry)?)?;
     let policy = band_selection_policy_from_opt(backup);
     archive.open_stored_tree(policy)
 }
 
-fn band_selection_policy_from_opt(backup: &Option<BandId>) -> BandSelectionPolicy {
-    if let Some(band_id) = backup {
-        BandSelectionPolicy::Specified(band_id.clone())
+/// Read the passphrase for signed archives from the environment.
+fn passphrase() -> Option<String> {
+    std::env::var("CONSERVE_PASSPHRASE")
+        .ok()
+        .filter(|passphrase| !passphrase.is_empty())
+}
+
+/// Load the key for an archive's manifest from `--key-file`, or derive it
+/// from the passphrase.
+fn manifest_key(archive: &Archive, key_file: &Option<PathBuf>) -> Result<ManifestKey> {
+    if let Some(key_file) = key_file {
+        ManifestKey::from_file(key_file)
+    } else if let Some(passphrase) = passphrase() {
+        ManifestKey::from_passphrase(archive, &passphrase)
+    } else {
+        Err(Error::ManifestKeyRequired)
+    }
+}
+
+/// If the archive is signed, return the key to rewrite its manifest.
+///
+/// This is called before changing the archive, so that a missing key is
+/// reported before anything is done.
+fn signing_key(archive: &Archive, key_file: &Option<PathBuf>) -> Result<Option<ManifestKey>> {
+    if archive.is_signed() {
+        manifest_key(archive, key_file).map(Some)
     } else {
-        BandSelectionPolicy::Latest
+        Ok(None)
+    }
+}
+
+/// Rewrite the manifest of a signed archive after it's changed.
+fn update_manifest(archive: &Archive, key: &Option<ManifestKey>) -> Result<()> {
+    match key {
+        Some(key) => write_manifest(archive, key),
+        None => Ok(()),
+    }
+}
+
+/// True if the entry is no deeper than `max_depth`, if that's given.
+fn within_depth<E: Entry>(entry: &E, max_depth: Option<usize>) -> bool {
+    max_depth.map_or(true, |max| entry.apath().depth() <= max)
+}
+
+/// Select a band by its id, such as `b1`, or otherwise by its label.
+fn band_selection_policy_from_opt(backup: &Option<String>) -> BandSelectionPolicy {
+    match backup {
+        Some(backup) => match backup.parse::<BandId>() {
+            Ok(band_id) => BandSelectionPolicy::Specified(band_id),
+            Err(_) => BandSelectionPolicy::Labelled(backup.clone()),
+        },
+        None => BandSelectionPolicy::Latest,
     }
 }
 
@@ -490,7 +1119,17 @@ fn main() {
             .init();
         trace!("tracing enabled");
     }
-    let result = args.command.run();
+    if let Some(jobs) = args.jobs {
+        rayon::ThreadPoolBuilder::new()
+            .num_threads(jobs)
+            .build_global()
+            .expect("configure thread pool");
+    }
+    let retry = RetryPolicy {
+        retries: args.retries,
+        initial_wait: args.retry_wait,
+    };
+    let result = args.command.run(&retry, &args.key_file);
     match result {
         Err(ref e) => {
             ui::show_error(e);
@@ -501,9 +1140,13 @@ fn main() {
             //     }
             // }
             // Avoid Rust redundantly printing the error.
-            std::process::exit(ExitCode::Failed as i32)
+            let code = match args.command {
+                Command::Diff { .. } => ExitCode::DiffFailed,
+                _ => ExitCode::Failed,
+            };
+            std::process::exit(code.code())
         }
-        Ok(code) => std::process::exit(code as i32),
+        Ok(code) => std::process::exit(code.code()),
     }
 }
 
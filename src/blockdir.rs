@@ -28,14 +28,12 @@ use std::path::Path;
 use std::sync::Arc;
 use std::time::Instant;
 
-use blake2_rfc::blake2b;
-use blake2_rfc::blake2b::Blake2b;
 use nutmeg::models::UnboundedModel;
 use rayon::prelude::*;
 use serde::{Deserialize, Serialize};
 use thousands::Separable;
 
-use crate::blockhash::BlockHash;
+use crate::blockhash::{BlockHash, HashAlgorithm};
 use crate::compress::snappy::{Compressor, Decompressor};
 use crate::kind::Kind;
 use crate::stats::{BackupStats, Sizes, ValidateStats};
@@ -43,8 +41,6 @@ use crate::transport::local::LocalTransport;
 use crate::transport::{DirEntry, ListDirNames, Transport};
 use crate::*;
 
-const BLOCKDIR_FILE_NAME_LEN: usize = crate::BLAKE_HASH_SIZE_BYTES * 2;
-
 /// Take this many characters from the block hash to form the subdirectory name.
 const SUBDIR_NAME_CHARS: usize = 3;
 
@@ -70,6 +66,8 @@ pub struct Address {
 #[derive(Clone, Debug)]
 pub struct BlockDir {
     transport: Arc<dyn Transport>,
+    /// Algorithm used to name blocks.
+    hash_algorithm: HashAlgorithm,
 }
 
 /// Returns the transport-relative subdirectory name.
@@ -91,6 +89,15 @@ impl BlockDir {
     pub fn open(transport: Box<dyn Transport>) -> BlockDir {
         BlockDir {
             transport: Arc::from(transport),
+            hash_algorithm: HashAlgorithm::default(),
+        }
+    }
+
+    /// Name blocks by this hash algorithm, rather than the default.
+    pub fn with_hash_algorithm(self, hash_algorithm: HashAlgorithm) -> BlockDir {
+        BlockDir {
+            hash_algorithm,
+            ..self
         }
     }
 
@@ -105,11 +112,12 @@ impl BlockDir {
             .map_err(|source| Error::CreateBlockDir { source })?;
         Ok(BlockDir {
             transport: Arc::from(transport),
+            hash_algorithm: HashAlgorithm::default(),
         })
     }
 
     /// Returns the number of compressed bytes.
-    pub(crate) fn compress_and_store(&mut self, in_buf: &[u8], hash: &BlockHash) -> Result<u64> {
+    pub(crate) fn compress_and_store(&self, in_buf: &[u8], hash: &BlockHash) -> Result<u64> {
         // TODO: Move this to a BlockWriter, which can hold a reusable buffer.
         let mut compressor = Compressor::new();
         let compressed = compressor.compress(in_buf)?;
@@ -137,22 +145,24 @@ impl BlockDir {
         Ok(comp_len)
     }
 
-    pub(crate) fn store_or_deduplicate(
-        &mut self,
+    /// Store a block whose hash has already been calculated, unless it's
+    /// already present.
+    pub(crate) fn store_hashed(
+        &self,
         block_data: &[u8],
+        hash: &BlockHash,
         stats: &mut BackupStats,
-    ) -> Result<BlockHash> {
-        let hash = self.hash_bytes(block_data);
-        if self.contains(&hash)? {
+    ) -> Result<()> {
+        if self.contains(hash)? {
             stats.deduplicated_blocks += 1;
             stats.deduplicated_bytes += block_data.len() as u64;
         } else {
-            let comp_len = self.compress_and_store(block_data, &hash)?;
+            let comp_len = self.compress_and_store(block_data, hash)?;
             stats.written_blocks += 1;
             stats.uncompressed_bytes += block_data.len() as u64;
             stats.compressed_bytes += comp_len;
         }
-        Ok(hash)
+        Ok(())
     }
 
     /// True if the named block is present in this directory.
@@ -196,6 +206,36 @@ impl BlockDir {
             .map_err(Error::from)
     }
 
+    /// Move a damaged block out of the block directory and into `quarantine`.
+    ///
+    /// The block is checked again first: if it can now be read and has the
+    /// right hash, it's left alone and this returns false.
+    pub(crate) fn quarantine_block(
+        &self,
+        hash: &BlockHash,
+        quarantine: &dyn Transport,
+    ) -> Result<bool> {
+        if self.get_block_content(hash).is_ok() {
+            return Ok(false);
+        }
+        let relpath = block_relpath(hash);
+        let quarantine_error = |source| Error::QuarantineBlock {
+            hash: hash.to_string(),
+            source,
+        };
+        let bytes = self
+            .transport
+            .read_file(&relpath)
+            .map_err(quarantine_error)?;
+        quarantine
+            .write_file(&hash.to_string(), &bytes)
+            .map_err(quarantine_error)?;
+        self.transport
+            .remove_file(&relpath)
+            .map_err(quarantine_error)?;
+        Ok(true)
+    }
+
     /// Return an iterator of block subdirectories, in arbitrary order.
     ///
     /// Errors, other than failure to open the directory at all, are logged and discarded.
@@ -217,6 +257,7 @@ impl BlockDir {
 
     fn iter_block_dir_entries(&self) -> Result<impl Iterator<Item = DirEntry>> {
         let transport = self.transport.clone();
+        let name_len = self.hash_algorithm.hash_len() * 2;
         Ok(self
             .subdirs()?
             .into_iter()
@@ -235,9 +276,7 @@ impl BlockDir {
                 iter_or.ok()
             })
             .filter(|DirEntry { name, kind, .. }| {
-                *kind == Kind::File
-                    && name.len() == BLOCKDIR_FILE_NAME_LEN
-                    && !name.starts_with(TMP_PREFIX)
+                *kind == Kind::File && name.len() == name_len && !name.starts_with(TMP_PREFIX)
             }))
     }
 
@@ -344,11 +383,7 @@ impl BlockDir {
                     hash: hash.to_string(),
                 })?;
         let decompressed_bytes = decompressor.decompress(&compressed_bytes)?;
-        let actual_hash = BlockHash::from(blake2b::blake2b(
-            BLAKE_HASH_SIZE_BYTES,
-            &[],
-            decompressed_bytes,
-        ));
+        let actual_hash = self.hash_algorithm.hash(decompressed_bytes);
         if actual_hash != *hash {
             ui::problem(&format!(
                 "Block file {:?} has actual decompressed hash {}",
@@ -366,9 +401,7 @@ impl BlockDir {
         Ok((decompressor.take_buffer(), sizes))
     }
 
-    fn hash_bytes(&self, in_buf: &[u8]) -> BlockHash {
-        let mut hasher = Blake2b::new(BLAKE_HASH_SIZE_BYTES);
-        hasher.update(in_buf);
-        BlockHash::from(hasher.finalize())
+    pub(crate) fn hash_bytes(&self, in_buf: &[u8]) -> BlockHash {
+        self.hash_algorithm.hash(in_buf)
     }
 }
@@ -11,7 +11,7 @@
 // MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
 // GNU General Public License for more details.
 
-//! Block hash address type.
+//! Block hash address type, and the hash algorithms that make them.
 
 use std::cmp::Ordering;
 use std::convert::TryFrom;
@@ -20,8 +20,10 @@ use std::fmt::{Debug, Display};
 use std::hash::{Hash, Hasher};
 use std::str::FromStr;
 
+use blake2_rfc::blake2b;
 use blake2_rfc::blake2b::Blake2bResult;
 use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
 
 use crate::*;
 
@@ -33,8 +35,93 @@ use crate::*;
 #[serde(into = "String")]
 #[serde(try_from = "&str")]
 pub struct BlockHash {
-    /// Binary hash.
+    /// Binary hash, of which the first `len` bytes are used.
     bin: [u8; BLAKE_HASH_SIZE_BYTES],
+    len: u8,
+}
+
+impl BlockHash {
+    fn from_bytes(bytes: &[u8]) -> BlockHash {
+        let mut bin = [0; BLAKE_HASH_SIZE_BYTES];
+        bin[..bytes.len()].copy_from_slice(bytes);
+        BlockHash {
+            bin,
+            len: bytes.len() as u8,
+        }
+    }
+
+    fn as_bytes(&self) -> &[u8] {
+        &self.bin[..self.len as usize]
+    }
+}
+
+/// The hash function used to name the blocks in an archive.
+///
+/// This is chosen when the archive is created, and every block in the
+/// archive is named by the same algorithm.
+#[derive(Debug, Clone, Copy, Eq, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum HashAlgorithm {
+    /// BLAKE2b with a 512-bit output: the default, and the only algorithm
+    /// used before 0.6.17.
+    Blake2b,
+    /// SHA-256, to match other systems.
+    Sha256,
+    /// BLAKE3, with a 256-bit output, which is faster on most machines.
+    Blake3,
+}
+
+impl HashAlgorithm {
+    /// Length of hashes from this algorithm, in bytes.
+    pub fn hash_len(self) -> usize {
+        match self {
+            HashAlgorithm::Blake2b => BLAKE_HASH_SIZE_BYTES,
+            HashAlgorithm::Sha256 | HashAlgorithm::Blake3 => 32,
+        }
+    }
+
+    /// Hash some data.
+    pub fn hash(self, data: &[u8]) -> BlockHash {
+        match self {
+            HashAlgorithm::Blake2b => {
+                BlockHash::from(blake2b::blake2b(BLAKE_HASH_SIZE_BYTES, &[], data))
+            }
+            HashAlgorithm::Sha256 => BlockHash::from_bytes(&Sha256::digest(data)),
+            HashAlgorithm::Blake3 => BlockHash::from_bytes(blake3::hash(data).as_bytes()),
+        }
+    }
+}
+
+impl Default for HashAlgorithm {
+    fn default() -> Self {
+        HashAlgorithm::Blake2b
+    }
+}
+
+impl FromStr for HashAlgorithm {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "blake2b" => Ok(HashAlgorithm::Blake2b),
+            "sha256" => Ok(HashAlgorithm::Sha256),
+            "blake3" => Ok(HashAlgorithm::Blake3),
+            _ => Err(format!(
+                "Unknown hash algorithm {:?}: should be blake2b, sha256, or blake3",
+                s
+            )),
+        }
+    }
+}
+
+impl Display for HashAlgorithm {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.pad(match self {
+            HashAlgorithm::Blake2b => "blake2b",
+            HashAlgorithm::Sha256 => "sha256",
+            HashAlgorithm::Blake3 => "blake3",
+        })
+    }
 }
 
 #[derive(Debug)]
@@ -51,18 +138,23 @@ impl Display for BlockHashParseError {
 impl FromStr for BlockHash {
     type Err = BlockHashParseError;
 
+    /// Parse a hex hash from any of the supported algorithms.
     fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
-        if s.len() != BLAKE_HASH_SIZE_BYTES * 2 {
+        let len = s.len() / 2;
+        if s.len() % 2 != 0 || !(len == BLAKE_HASH_SIZE_BYTES || len == 32) {
             return Err(BlockHashParseError {
                 rejected_string: s.to_owned(),
             });
         }
         let mut bin = [0; BLAKE_HASH_SIZE_BYTES];
-        hex::decode_to_slice(s, &mut bin)
+        hex::decode_to_slice(s, &mut bin[..len])
             .map_err(|_| BlockHashParseError {
                 rejected_string: s.to_owned(),
             })
-            .and(Ok(BlockHash { bin }))
+            .and(Ok(BlockHash {
+                bin,
+                len: len as u8,
+            }))
     }
 }
 
@@ -82,39 +174,37 @@ impl Debug for BlockHash {
 
 impl Display for BlockHash {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
-        write!(f, "{}", hex::encode(&self.bin[..]))
+        write!(f, "{}", hex::encode(self.as_bytes()))
     }
 }
 
 impl From<BlockHash> for String {
     fn from(hash: BlockHash) -> String {
-        hex::encode(&hash.bin[..])
+        hex::encode(hash.as_bytes())
     }
 }
 
 impl From<Blake2bResult> for BlockHash {
     fn from(hash: Blake2bResult) -> BlockHash {
-        let mut bin = [0; BLAKE_HASH_SIZE_BYTES];
-        bin.copy_from_slice(hash.as_bytes());
-        BlockHash { bin }
+        BlockHash::from_bytes(hash.as_bytes())
     }
 }
 
 impl Ord for BlockHash {
     fn cmp(&self, other: &Self) -> Ordering {
-        self.bin.cmp(&other.bin)
+        self.as_bytes().cmp(other.as_bytes())
     }
 }
 
 impl PartialOrd for BlockHash {
     fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
-        Some(self.bin.cmp(&other.bin))
+        Some(self.cmp(other))
     }
 }
 
 impl PartialEq for BlockHash {
     fn eq(&self, other: &Self) -> bool {
-        self.bin[..] == other.bin[..]
+        self.as_bytes() == other.as_bytes()
     }
 }
 
@@ -122,6 +212,73 @@ impl Eq for BlockHash {}
 
 impl Hash for BlockHash {
     fn hash<H: Hasher>(&self, state: &mut H) {
-        self.bin.hash(state);
+        self.as_bytes().hash(state);
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::time::Instant;
+
+    use super::*;
+
+    const ALGORITHMS: [HashAlgorithm; 3] = [
+        HashAlgorithm::Blake2b,
+        HashAlgorithm::Sha256,
+        HashAlgorithm::Blake3,
+    ];
+
+    #[test]
+    fn hashes_round_trip_through_strings() {
+        for algorithm in ALGORITHMS {
+            let hash = algorithm.hash(b"some data");
+            let s = hash.to_string();
+            assert_eq!(s.len(), algorithm.hash_len() * 2);
+            assert_eq!(s.parse::<BlockHash>().unwrap(), hash);
+        }
+    }
+
+    #[test]
+    fn sha256_known_value() {
+        assert_eq!(
+            HashAlgorithm::Sha256.hash(b"abc").to_string(),
+            "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+        );
+    }
+
+    #[test]
+    fn parse_algorithm_names() {
+        for algorithm in ALGORITHMS {
+            assert_eq!(
+                algorithm.to_string().parse::<HashAlgorithm>(),
+                Ok(algorithm)
+            );
+        }
+        assert!("md5".parse::<HashAlgorithm>().is_err());
+    }
+
+    #[test]
+    fn reject_wrong_length_hash() {
+        assert!("abcd".parse::<BlockHash>().is_err());
+        assert!("a".repeat(63).parse::<BlockHash>().is_err());
+    }
+
+    /// Compare the speed of the hash algorithms on this machine.
+    ///
+    /// Run with `cargo test --release -- --ignored --nocapture compare_hash_speed`.
+    #[test]
+    #[ignore]
+    fn compare_hash_speed() {
+        let data = vec![0x5au8; 64 << 20];
+        for algorithm in ALGORITHMS {
+            let start = Instant::now();
+            algorithm.hash(&data);
+            let elapsed = start.elapsed();
+            println!(
+                "{:<8} {:>8.1} MB/s",
+                algorithm,
+                data.len() as f64 / 1e6 / elapsed.as_secs_f64()
+            );
+        }
     }
 }
@@ -0,0 +1,107 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Check that a source tree can be read, before backing it up.
+//!
+//! The tree is walked the same way as by a backup, and every file is opened,
+//! but no content is read and nothing is written.
+//!
+//! Symlinks are stored rather than followed, so they can't cause loops.
+
+use std::fs;
+
+use crate::stats::CheckSourceStats;
+use crate::*;
+
+/// Walk a source tree, reporting any files or directories that can't be read.
+///
+/// Returns `Err(Error::ListSourceTree)` if the top directory can't be read
+/// at all.
+pub fn check_source(source: &LiveTree, exclude: Exclude) -> Result<CheckSourceStats> {
+    fs::read_dir(source.path()).map_err(|io_error| Error::ListSourceTree {
+        path: source.path().to_owned(),
+        source: io_error,
+    })?;
+    let mut stats = CheckSourceStats::default();
+    let mut iter = source.iter_entries(Apath::root(), exclude)?;
+    for entry in &mut iter {
+        match entry.kind() {
+            Kind::Dir => stats.directories += 1,
+            Kind::Symlink => stats.symlinks += 1,
+            Kind::Fifo | Kind::BlockDevice | Kind::CharDevice => stats.special_files += 1,
+            Kind::Unknown => stats.unknown_kind += 1,
+            Kind::File => {
+                stats.files += 1;
+                stats.file_bytes += entry.size().unwrap_or_default();
+                if let Err(err) = source.file_contents(&entry) {
+                    ui::show_error(&err);
+                    stats.unreadable_files += 1;
+                }
+            }
+        }
+    }
+    let iter_stats = iter.stats();
+    stats.unreadable_directories = iter_stats.unreadable_directories;
+    stats.metadata_errors = iter_stats.metadata_error;
+    stats.exclusions = iter_stats.exclusions;
+    Ok(stats)
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::test_fixtures::TreeFixture;
+
+    #[test]
+    fn count_readable_tree() {
+        let tf = TreeFixture::new();
+        tf.create_file_with_contents("hello", b"hello world");
+        tf.create_dir("subdir");
+        tf.create_file("subdir/a");
+        tf.create_file("subdir/excluded");
+        let exclude = Exclude::from_strings(&["excluded"]).unwrap();
+        let stats = check_source(&tf.live_tree(), exclude).unwrap();
+        assert_eq!(stats.files, 2);
+        assert_eq!(stats.directories, 2);
+        assert_eq!(stats.file_bytes, 19);
+        assert_eq!(stats.exclusions, 1);
+        assert!(!stats.has_problems());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn report_unreadable_file() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let tf = TreeFixture::new();
+        let path = tf.create_file("secret");
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o000)).unwrap();
+        if fs::File::open(&path).is_ok() {
+            // Running as root, so permissions aren't enforced.
+            return;
+        }
+        let stats = check_source(&tf.live_tree(), Exclude::nothing()).unwrap();
+        assert_eq!(stats.unreadable_files, 1);
+        assert!(stats.has_problems());
+    }
+
+    #[test]
+    fn missing_source_is_an_error() {
+        let tf = TreeFixture::new();
+        let source = LiveTree::open(tf.path().join("nonexistent")).unwrap();
+        assert!(matches!(
+            check_source(&source, Exclude::nothing()),
+            Err(Error::ListSourceTree { .. })
+        ));
+    }
+}
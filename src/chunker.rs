@@ -0,0 +1,200 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Split large files into blocks at boundaries chosen by their content.
+//!
+//! By default large files are cut into blocks of `MAX_BLOCK_SIZE`, so
+//! inserting or removing bytes near the start of a file shifts every later
+//! block, and none of them match the blocks already in the archive.
+//!
+//! With content-defined chunking, a rolling "gear" hash is computed over the
+//! data, and a block ends wherever the hash has a particular pattern of zero
+//! bits. Boundaries depend only on the nearby content, so after an edit they
+//! soon line up again with the boundaries in the previous version, and the
+//! later blocks are deduplicated.
+//!
+//! This changes only how the blocks are cut: the index lists each block's
+//! address in order, exactly as it does for fixed-size blocks, so restoring
+//! files doesn't depend on how they were chunked.
+
+use crate::misc::parse_bytes;
+use crate::MAX_BLOCK_SIZE;
+
+/// Smallest average chunk size that can be requested.
+const MIN_AVERAGE_SIZE: usize = 4096;
+
+/// Sizes for content-defined chunks.
+#[derive(Debug, Clone, Copy, Eq, PartialEq)]
+pub struct ChunkSizes {
+    /// No chunk, other than the last one in a file, is smaller than this.
+    pub min: usize,
+    /// The typical size of chunks.
+    pub avg: usize,
+    /// Every chunk is at most this big.
+    pub max: usize,
+}
+
+impl ChunkSizes {
+    /// Choose minimum and maximum sizes around an average chunk size.
+    pub fn from_average(avg: usize) -> ChunkSizes {
+        ChunkSizes {
+            min: avg / 4,
+            avg,
+            max: (avg * 4).min(MAX_BLOCK_SIZE),
+        }
+    }
+
+    /// Return the length of the first chunk at the start of `data`.
+    ///
+    /// If `data` is shorter than `max` it's assumed to be the end of the file,
+    /// so all of it is returned if no boundary is found.
+    pub(crate) fn find_boundary(&self, data: &[u8]) -> usize {
+        let limit = data.len().min(self.max);
+        if limit <= self.min {
+            return limit;
+        }
+        // A boundary occurs where the top `bits` bits of the hash are zero,
+        // which happens on average once every `avg` bytes.
+        let bits = usize::BITS - self.avg.leading_zeros() - 1;
+        let mut hash: u64 = 0;
+        for (i, &byte) in data[..limit].iter().enumerate() {
+            hash = (hash << 1).wrapping_add(GEAR[byte as usize]);
+            if i >= self.min && hash >> (64 - bits) == 0 {
+                return i + 1;
+            }
+        }
+        limit
+    }
+}
+
+/// Parse an average chunk size such as `256KB`.
+pub fn parse_average_chunk_size(s: &str) -> std::result::Result<ChunkSizes, String> {
+    let avg = parse_bytes(s)? as usize;
+    if avg < MIN_AVERAGE_SIZE || avg > MAX_BLOCK_SIZE / 4 {
+        return Err(format!(
+            "Average chunk size must be between {} and {} bytes",
+            MIN_AVERAGE_SIZE,
+            MAX_BLOCK_SIZE / 4
+        ));
+    }
+    Ok(ChunkSizes::from_average(avg))
+}
+
+/// Pseudo-random values for each byte, used by the gear hash.
+///
+/// These must never change, or chunks from files stored by previous
+/// versions won't be matched.
+const GEAR: [u64; 256] = gear_table();
+
+/// Fill the gear table from splitmix64 with a fixed seed.
+const fn gear_table() -> [u64; 256] {
+    let mut table = [0u64; 256];
+    let mut state: u64 = 0x636f_6e73_6572_7665;
+    let mut i = 0;
+    while i < 256 {
+        state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        table[i] = z ^ (z >> 31);
+        i += 1;
+    }
+    table
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    /// Deterministic pseudo-random test data.
+    fn sample_data(len: usize) -> Vec<u8> {
+        let mut state: u32 = 1;
+        (0..len)
+            .map(|_| {
+                state = state.wrapping_mul(1_103_515_245).wrapping_add(12345);
+                (state >> 16) as u8
+            })
+            .collect()
+    }
+
+    fn chunk_lengths(sizes: &ChunkSizes, mut data: &[u8]) -> Vec<usize> {
+        let mut lengths = Vec::new();
+        while !data.is_empty() {
+            let len = sizes.find_boundary(&data[..data.len().min(sizes.max)]);
+            lengths.push(len);
+            data = &data[len..];
+        }
+        lengths
+    }
+
+    #[test]
+    fn chunks_are_within_bounds() {
+        let sizes = ChunkSizes::from_average(8192);
+        let data = sample_data(1_000_000);
+        let lengths = chunk_lengths(&sizes, &data);
+        assert_eq!(lengths.iter().sum::<usize>(), data.len());
+        let (last, rest) = lengths.split_last().unwrap();
+        assert!(*last <= sizes.max);
+        for len in rest {
+            assert!(*len > sizes.min && *len <= sizes.max, "{}", len);
+        }
+        // Roughly the requested average, allowing for the minimum size.
+        let mean = data.len() / lengths.len();
+        assert!(mean > sizes.avg / 2 && mean < sizes.avg * 2, "{}", mean);
+    }
+
+    #[test]
+    fn boundaries_resynchronize_after_insertion() {
+        let sizes = ChunkSizes::from_average(8192);
+        let data = sample_data(500_000);
+        let mut edited = b"a few inserted bytes".to_vec();
+        edited.extend_from_slice(&data);
+        let original = chunk_lengths(&sizes, &data);
+        let after_edit = chunk_lengths(&sizes, &edited);
+        // Most of the chunks at the end are the same.
+        let common = original
+            .iter()
+            .rev()
+            .zip(after_edit.iter().rev())
+            .take_while(|(a, b)| a == b)
+            .count();
+        assert!(
+            common > original.len() / 2,
+            "{} of {}",
+            common,
+            original.len()
+        );
+    }
+
+    #[test]
+    fn short_data_is_one_chunk() {
+        let sizes = ChunkSizes::from_average(8192);
+        assert_eq!(sizes.find_boundary(&sample_data(100)), 100);
+        assert_eq!(sizes.find_boundary(&[]), 0);
+    }
+
+    #[test]
+    fn parse_sizes() {
+        assert_eq!(
+            parse_average_chunk_size("64KB"),
+            Ok(ChunkSizes {
+                min: 16_000,
+                avg: 64_000,
+                max: 256_000
+            })
+        );
+        assert!(parse_average_chunk_size("100").is_err());
+        assert!(parse_average_chunk_size("1MB").is_err());
+        assert!(parse_average_chunk_size("big").is_err());
+    }
+}
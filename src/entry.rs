@@ -16,7 +16,7 @@
 
 use std::fmt::Debug;
 
-use crate::kind::Kind;
+use crate::kind::{DeviceNumber, Kind};
 use crate::unix_time::UnixTime;
 use crate::*;
 
@@ -27,6 +27,18 @@ pub trait Entry: Debug + Eq + PartialEq {
     fn size(&self) -> Option<u64>;
     fn symlink_target(&self) -> &Option<String>;
 
+    /// Unix permission bits, including setuid, setgid and sticky bits, if known.
+    fn unix_mode(&self) -> Option<u32>;
+
+    /// Numeric user id of the owner, if known.
+    fn uid(&self) -> Option<u32>;
+
+    /// Numeric group id of the owner, if known.
+    fn gid(&self) -> Option<u32>;
+
+    /// For device nodes, the device they refer to.
+    fn device(&self) -> Option<DeviceNumber>;
+
     /// True if the metadata supports an assumption the file contents have
     /// not changed.
     fn is_unchanged_from<O: Entry>(&self, basis_entry: &O) -> bool {
@@ -37,6 +37,9 @@ pub enum Error {
     #[error("Failed to read block {hash:?}")]
     ReadBlock { hash: String, source: IOError },
 
+    #[error("Failed to move block {hash:?} into quarantine")]
+    QuarantineBlock { hash: String, source: IOError },
+
     #[error("Failed to list block files")]
     ListBlocks { source: IOError },
 
@@ -62,9 +65,63 @@ pub enum Error {
     #[error("Destination directory not empty: {:?}", path)]
     DestinationNotEmpty { path: PathBuf },
 
+    #[error("Can't restore {path:?} because an entry restored earlier has a name that this filesystem treats as the same")]
+    RestoreNameCollision { path: PathBuf },
+
+    #[error("Path {apath} is not present in backup {band_id}")]
+    SubtreeNotFound { apath: Apath, band_id: BandId },
+
+    #[error("No retention rules given: use --keep-last or --keep-within")]
+    EmptyRetentionPolicy,
+
+    #[error("Path {apath} is not a file: it's a {kind:?}")]
+    NotAFile { apath: Apath, kind: Kind },
+
+    #[error("Only one file can be restored to stdout, but {apath} is a {kind:?}; use export-tar to write a whole tree")]
+    RestoreToStdoutNotAFile { apath: Apath, kind: Kind },
+
+    #[error(
+        "Backup {band_id} does not exist; available backups are: {}",
+        format_band_ids(available)
+    )]
+    BandNotFound {
+        band_id: BandId,
+        available: Vec<BandId>,
+    },
+
     #[error("Archive has no bands")]
     ArchiveEmpty,
 
+    #[error("No backup has the label {label:?}")]
+    LabelNotFound { label: String },
+
+    #[error(
+        "Label {label:?} is ambiguous; it matches backups {}",
+        format_band_ids(band_ids)
+    )]
+    AmbiguousLabel {
+        label: String,
+        band_ids: Vec<BandId>,
+    },
+
+    #[error("Label {label:?} can't be used because it looks like a backup id")]
+    InvalidLabel { label: String },
+
+    #[error(
+        "Block size {block_size} must be between {} and {} bytes",
+        crate::archive::MIN_BLOCK_SIZE,
+        crate::archive::LARGEST_BLOCK_SIZE
+    )]
+    InvalidBlockSize { block_size: usize },
+
+    #[error(
+        "Chunks of up to {chunk_size} bytes don't fit in this archive's {block_size}-byte blocks"
+    )]
+    ChunkSizeTooLarge {
+        chunk_size: usize,
+        block_size: usize,
+    },
+
     #[error("Directory for new archive is not empty")]
     NewArchiveDirectoryNotEmpty,
 
@@ -92,9 +149,42 @@ pub enum Error {
     #[error("Can't continue with deletion because the archive was changed by another process")]
     DeleteWithConcurrentActivity,
 
+    #[error("{problem}")]
+    SelfTestProblem { problem: String },
+
+    #[error("Self-test failed: {message}; test files are left in {path:?}")]
+    SelfTestFailed { message: String, path: PathBuf },
+
+    #[error("Failed to mount archive on {path:?}")]
+    Mount { path: PathBuf, source: IOError },
+
+    #[error("Failed to read key file {path:?}")]
+    ReadKeyFile { path: PathBuf, source: IOError },
+
+    #[error("Key file {path:?} is empty")]
+    EmptyKeyFile { path: PathBuf },
+
+    #[error("Archive is signed: give --key-file or set $CONSERVE_PASSPHRASE")]
+    ManifestKeyRequired,
+
+    #[error("Archive isn't signed, so a key can't be derived from a passphrase")]
+    ArchiveNotSigned,
+
+    #[error("Failed to read archive manifest")]
+    ReadManifest { source: IOError },
+
+    #[error("Failed to generate a random salt")]
+    GenerateSalt { source: IOError },
+
     #[error("Archive is locked for garbage collection")]
     GarbageCollectionLockHeld,
 
+    #[error(
+        "Archive is locked by another backup ({}); if it's no longer running, use --break-lock",
+        format_lock_holder(holder)
+    )]
+    BackupLockHeld { holder: Option<BackupLockHolder> },
+
     #[error(transparent)]
     ParseGlob {
         #[from]
@@ -161,6 +251,9 @@ pub enum Error {
     #[error("Failed to restore modification time on {:?}", path)]
     RestoreModificationTime { path: PathBuf, source: IOError },
 
+    #[error("Failed to restore permissions on {:?}", path)]
+    RestorePermissions { path: PathBuf, source: IOError },
+
     #[error("Failed to delete band {}", band_id)]
     BandDeletion { band_id: BandId, source: IOError },
 
@@ -180,3 +273,30 @@ pub enum Error {
         source: snap::Error,
     },
 }
+
+/// Describe the process holding a backup lock, for an error message.
+fn format_lock_holder(holder: &Option<BackupLockHolder>) -> String {
+    match holder {
+        Some(BackupLockHolder { pid, start_time }) => format!(
+            "pid {}, since {}",
+            pid,
+            start_time
+                .with_timezone(&chrono::Local)
+                .format(crate::TIMESTAMP_FORMAT)
+        ),
+        None => "unknown process".to_owned(),
+    }
+}
+
+/// Format a list of band ids for an error message.
+fn format_band_ids(band_ids: &[BandId]) -> String {
+    if band_ids.is_empty() {
+        "none".to_owned()
+    } else {
+        band_ids
+            .iter()
+            .map(BandId::to_string)
+            .collect::<Vec<String>>()
+            .join(", ")
+    }
+}
@@ -28,6 +28,10 @@ use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
 
 use super::*;
 
+/// Name of a file at the top of a source tree holding exclusion patterns
+/// for that tree, in the same format as `--exclude-from`.
+pub const IGNORE_FILE_NAME: &str = ".conserveignore";
+
 /// Describes which files to exclude from a backup, restore, etc.
 #[derive(Clone, Debug)]
 pub struct Exclude {
@@ -118,6 +122,16 @@ impl ExcludeBuilder {
         Ok(self)
     }
 
+    /// Add patterns from the [IGNORE_FILE_NAME] file at the top of a source
+    /// tree, if it has one.
+    pub fn add_source_ignore_file(&mut self, source: &Path) -> Result<&mut ExcludeBuilder> {
+        let path = source.join(IGNORE_FILE_NAME);
+        if path.is_file() {
+            self.add_file(&path)?;
+        }
+        Ok(self)
+    }
+
     /// Build from command line arguments of patterns and filenames.
     pub fn from_args(exclude: &[String], exclude_from: &[String]) -> Result<ExcludeBuilder> {
         let mut builder = ExcludeBuilder::new();
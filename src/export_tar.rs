@@ -0,0 +1,160 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Export a stored tree as a tar file, so it can be used without Conserve.
+//!
+//! Entries are written in the same order and with the same metadata as a
+//! restore, but into a stream rather than onto the filesystem. Paths in the
+//! tar file are relative, without the leading `/` of the apath.
+//!
+//! The archive doesn't record hardlinks, so linked files are written as
+//! separate copies.
+
+use std::io::{self, Write};
+use std::time::Instant;
+
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use tar::{EntryType, Header};
+
+use crate::stats::RestoreStats;
+use crate::*;
+
+/// Description of how to export a tree.
+#[derive(Debug)]
+pub struct ExportTarOptions {
+    pub exclude: Exclude,
+    /// Export only this subdirectory.
+    pub only_subtree: Option<Apath>,
+    /// The band to select, or by default the last complete one.
+    pub band_selection: BandSelectionPolicy,
+    /// Compress the tar file with gzip.
+    pub gzip: bool,
+}
+
+impl Default for ExportTarOptions {
+    fn default() -> Self {
+        ExportTarOptions {
+            exclude: Exclude::nothing(),
+            only_subtree: None,
+            band_selection: BandSelectionPolicy::LatestClosed,
+            gzip: false,
+        }
+    }
+}
+
+/// Write a selected version, or by default the latest, as a tar file.
+///
+/// Because the output is a stream, an error reading any file stops the
+/// export.
+pub fn export_tar(
+    archive: &Archive,
+    w: &mut dyn Write,
+    options: &ExportTarOptions,
+) -> Result<RestoreStats> {
+    let st = archive.open_stored_tree(options.band_selection.clone())?;
+    if options.gzip {
+        let mut encoder = GzEncoder::new(w, Compression::default());
+        let stats = write_tar(&st, &mut encoder, options)?;
+        encoder.finish()?;
+        Ok(stats)
+    } else {
+        write_tar(&st, w, options)
+    }
+}
+
+fn write_tar<W: Write>(st: &StoredTree, w: W, options: &ExportTarOptions) -> Result<RestoreStats> {
+    let start = Instant::now();
+    let mut entry_iter = st
+        .iter_entries(
+            options.only_subtree.clone().unwrap_or_else(Apath::root),
+            options.exclude.clone(),
+        )?
+        .peekable();
+    if let Some(only_subtree) = &options.only_subtree {
+        if entry_iter.peek().is_none() {
+            return Err(Error::SubtreeNotFound {
+                apath: only_subtree.clone(),
+                band_id: st.band().id().clone(),
+            });
+        }
+    }
+    let mut builder = tar::Builder::new(w);
+    let mut stats = RestoreStats::default();
+    for entry in entry_iter {
+        let path = &entry.apath()[1..];
+        if path.is_empty() {
+            // The root directory has no entry of its own.
+            continue;
+        }
+        let mut header = Header::new_gnu();
+        header.set_mtime(entry.mtime().secs.max(0) as u64);
+        if let Some(uid) = entry.uid() {
+            header.set_uid(uid.into());
+        }
+        if let Some(gid) = entry.gid() {
+            header.set_gid(gid.into());
+        }
+        match entry.kind() {
+            Kind::Dir => {
+                stats.directories += 1;
+                header.set_entry_type(EntryType::Directory);
+                header.set_mode(entry.unix_mode().unwrap_or(0o755));
+                header.set_size(0);
+                builder.append_data(&mut header, path, io::empty())?;
+            }
+            Kind::File if entry.unrecoverable => {
+                ui::problem(&format!("Skipping unrecoverable file {}", entry.apath()));
+                stats.unrecoverable_files += 1;
+            }
+            Kind::File => {
+                stats.files += 1;
+                let size = entry.size().unwrap_or_default();
+                header.set_entry_type(EntryType::Regular);
+                header.set_mode(entry.unix_mode().unwrap_or(0o644));
+                header.set_size(size);
+                builder.append_data(&mut header, path, st.file_contents(&entry)?)?;
+                stats.uncompressed_file_bytes += size;
+            }
+            Kind::Symlink => {
+                stats.symlinks += 1;
+                header.set_entry_type(EntryType::Symlink);
+                header.set_mode(entry.unix_mode().unwrap_or(0o777));
+                header.set_size(0);
+                let target = entry.symlink_target().as_deref().unwrap_or_default();
+                builder.append_link(&mut header, path, target)?;
+            }
+            Kind::Fifo | Kind::BlockDevice | Kind::CharDevice => {
+                stats.special_files += 1;
+                header.set_entry_type(match entry.kind() {
+                    Kind::Fifo => EntryType::Fifo,
+                    Kind::BlockDevice => EntryType::Block,
+                    _ => EntryType::Char,
+                });
+                header.set_mode(entry.unix_mode().unwrap_or(0o644));
+                header.set_size(0);
+                if let Some(device) = entry.device() {
+                    header.set_device_major(device.major)?;
+                    header.set_device_minor(device.minor)?;
+                }
+                builder.append_data(&mut header, path, io::empty())?;
+            }
+            Kind::Unknown => {
+                stats.unknown_kind += 1;
+            }
+        }
+    }
+    builder.into_inner()?.flush()?;
+    stats.elapsed = start.elapsed();
+    Ok(stats)
+}
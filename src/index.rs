@@ -14,6 +14,7 @@
 //! Index lists the files in a band in the archive.
 
 use std::cmp::Ordering;
+use std::collections::BTreeSet;
 use std::io;
 use std::iter::Peekable;
 use std::path::Path;
@@ -71,6 +72,35 @@ pub struct IndexEntry {
     #[serde(default)]
     #[serde(skip_serializing_if = "Option::is_none")]
     pub target: Option<String>,
+
+    /// Unix permission bits, not including the file type.
+    ///
+    /// This is absent in indexes written prior to 0.6.17, and for files
+    /// backed up from non-Unix systems.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub unix_mode: Option<u32>,
+
+    /// Numeric user id of the owner, on Unix.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub uid: Option<u32>,
+
+    /// Numeric group id of the owner, on Unix.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub gid: Option<u32>,
+
+    /// For block and character devices, the device major and minor numbers.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub device: Option<DeviceNumber>,
+
+    /// True if the content of this file was found to be damaged, and it
+    /// has been marked so that it's skipped by restore.
+    #[serde(default)]
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub unrecoverable: bool,
 }
 // GRCOV_EXCLUDE_STOP
 
@@ -103,6 +133,26 @@ impl Entry for IndexEntry {
     fn symlink_target(&self) -> &Option<String> {
         &self.target
     }
+
+    #[inline]
+    fn unix_mode(&self) -> Option<u32> {
+        self.unix_mode
+    }
+
+    #[inline]
+    fn uid(&self) -> Option<u32> {
+        self.uid
+    }
+
+    #[inline]
+    fn gid(&self) -> Option<u32> {
+        self.gid
+    }
+
+    #[inline]
+    fn device(&self) -> Option<DeviceNumber> {
+        self.device
+    }
 }
 
 impl IndexEntry {
@@ -120,6 +170,11 @@ impl IndexEntry {
             target: source.symlink_target().clone(),
             mtime: mtime.secs,
             mtime_nanos: mtime.nanosecs,
+            unix_mode: source.unix_mode(),
+            uid: source.uid(),
+            gid: source.gid(),
+            device: source.device(),
+            unrecoverable: false,
         }
     }
 }
@@ -214,7 +269,7 @@ impl IndexWriter {
         }
         let compressed_bytes = self.compressor.compress(&json)?;
         self.transport
-            .write_file(&relpath, compressed_bytes)
+            .write_file_durably(&relpath, compressed_bytes)
             .map_err(write_error)?;
 
         self.stats.index_hunks += 1;
@@ -284,6 +339,53 @@ impl IndexRead {
         IndexEntryIter::new(self.iter_hunks(), Apath::root(), Exclude::nothing())
     }
 
+    /// Mark the entries with any of the given apaths as unrecoverable,
+    /// rewriting the hunks that contain them.
+    ///
+    /// Returns the number of entries that were newly marked.
+    pub(crate) fn mark_unrecoverable(&self, apaths: &BTreeSet<Apath>) -> Result<usize> {
+        let mut decompressor = Decompressor::new();
+        let mut compressor = Compressor::new();
+        let mut marked = 0;
+        for hunk_number in 0..self.count_hunks()? {
+            let relpath = hunk_relpath(hunk_number);
+            let compressed_bytes =
+                self.transport
+                    .read_file(&relpath)
+                    .map_err(|source| Error::ReadIndex {
+                        path: relpath.clone(),
+                        source,
+                    })?;
+            let mut entries: Vec<IndexEntry> = serde_json::from_slice(
+                decompressor.decompress(&compressed_bytes)?,
+            )
+            .map_err(|source| Error::DeserializeIndex {
+                path: relpath.clone(),
+                source,
+            })?;
+            let mut changed = false;
+            for entry in entries
+                .iter_mut()
+                .filter(|entry| !entry.unrecoverable && apaths.contains(&entry.apath))
+            {
+                entry.unrecoverable = true;
+                changed = true;
+                marked += 1;
+            }
+            if changed {
+                let json = serde_json::to_vec(&entries)
+                    .map_err(|source| Error::SerializeIndex { source })?;
+                self.transport
+                    .write_file_durably(&relpath, compressor.compress(&json)?)
+                    .map_err(|source| Error::WriteIndex {
+                        path: relpath.clone(),
+                        source,
+                    })?;
+            }
+        }
+        Ok(marked)
+    }
+
     /// Make an iterator that returns hunks of entries from this index.
     pub fn iter_hunks(&self) -> IndexHunkIter {
         IndexHunkIter {
@@ -511,6 +613,11 @@ mod tests {
             kind: Kind::File,
             addrs: vec![],
             target: None,
+            unix_mode: None,
+            uid: None,
+            gid: None,
+            device: None,
+            unrecoverable: false,
         }
     }
 
@@ -523,6 +630,11 @@ mod tests {
             kind: Kind::File,
             addrs: vec![],
             target: None,
+            unix_mode: None,
+            uid: None,
+            gid: None,
+            device: None,
+            unrecoverable: false,
         }];
         let index_json = serde_json::to_string(&entries).unwrap();
         println!("{}", index_json);
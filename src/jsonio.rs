@@ -34,7 +34,7 @@ where
     s.push('\n');
     transport
         .as_ref()
-        .write_file(relpath, s.as_bytes())
+        .write_file_durably(relpath, s.as_bytes())
         .map_err(|source| Error::WriteMetadata {
             path: relpath.to_owned(),
             source,
@@ -26,10 +26,23 @@ pub enum Kind {
     File,
     Dir,
     Symlink,
+    /// Named pipe, on Unix.
+    Fifo,
+    /// Block device node, on Unix.
+    BlockDevice,
+    /// Character device node, on Unix.
+    CharDevice,
     /// Unknown file observed in local tree. Shouldn't be stored.
     Unknown,
 }
 
+impl Kind {
+    /// True for device nodes, which have a device number.
+    pub fn is_device(self) -> bool {
+        matches!(self, Kind::BlockDevice | Kind::CharDevice)
+    }
+}
+
 impl From<FileType> for Kind {
     fn from(ft: FileType) -> Kind {
         if ft.is_file() {
@@ -39,7 +52,75 @@ impl From<FileType> for Kind {
         } else if ft.is_symlink() {
             Kind::Symlink
         } else {
-            Kind::Unknown
+            special_kind(ft)
+        }
+    }
+}
+
+#[cfg(unix)]
+fn special_kind(ft: FileType) -> Kind {
+    use std::os::unix::fs::FileTypeExt;
+    if ft.is_fifo() {
+        Kind::Fifo
+    } else if ft.is_block_device() {
+        Kind::BlockDevice
+    } else if ft.is_char_device() {
+        Kind::CharDevice
+    } else {
+        Kind::Unknown
+    }
+}
+
+#[cfg(not(unix))]
+fn special_kind(_ft: FileType) -> Kind {
+    Kind::Unknown
+}
+
+/// The major and minor numbers identifying the device of a device node.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DeviceNumber {
+    pub major: u32,
+    pub minor: u32,
+}
+
+#[cfg(unix)]
+impl DeviceNumber {
+    /// Split a combined `st_rdev` into its major and minor numbers.
+    pub fn from_rdev(rdev: u64) -> DeviceNumber {
+        let rdev = rdev as libc::dev_t;
+        DeviceNumber {
+            major: libc::major(rdev) as u32,
+            minor: libc::minor(rdev) as u32,
         }
     }
+
+    /// Combine the major and minor numbers into a `dev_t`, as used by
+    /// `mknod`.
+    pub fn rdev(self) -> libc::dev_t {
+        libc::makedev(self.major as _, self.minor as _)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    #[cfg(unix)]
+    fn device_number_round_trip() {
+        let device = DeviceNumber {
+            major: 259,
+            minor: 70000,
+        };
+        assert_eq!(DeviceNumber::from_rdev(device.rdev() as u64), device);
+    }
+
+    #[test]
+    fn serialize_special_kinds() {
+        assert_eq!(serde_json::to_string(&Kind::Fifo).unwrap(), "\"Fifo\"");
+        assert_eq!(
+            serde_json::to_string(&Kind::CharDevice).unwrap(),
+            "\"CharDevice\""
+        );
+    }
 }
@@ -16,24 +16,34 @@
 pub mod apath;
 pub mod archive;
 pub mod backup;
+mod backup_lock;
 mod band;
 pub mod bandid;
 mod blockdir;
 pub mod blockhash;
+mod check_source;
+pub mod chunker;
 pub mod compress;
 mod diff;
 mod entry;
 pub mod errors;
 pub mod excludes;
+mod export_tar;
 mod gc_lock;
 pub mod index;
 mod io;
 mod jsonio;
 pub mod kind;
 pub mod live_tree;
+pub mod manifest;
 mod merge;
 pub(crate) mod misc;
+#[cfg(feature = "fuse")]
+mod mount;
+pub mod observer;
+pub mod prune;
 pub mod restore;
+mod selftest;
 pub mod show;
 pub mod stats;
 mod stitch;
@@ -48,30 +58,45 @@ mod validate;
 
 pub use crate::apath::Apath;
 pub use crate::archive::Archive;
+pub use crate::archive::ArchiveOptions;
 pub use crate::archive::DeleteOptions;
 pub use crate::backup::{backup, BackupOptions};
+pub use crate::backup_lock::{BackupLock, BackupLockHolder};
 pub use crate::band::Band;
 pub use crate::band::BandSelectionPolicy;
 pub use crate::bandid::BandId;
 pub use crate::blockdir::BlockDir;
-pub use crate::blockhash::BlockHash;
+pub use crate::blockhash::{BlockHash, HashAlgorithm};
+pub use crate::check_source::check_source;
+pub use crate::chunker::ChunkSizes;
 pub use crate::diff::{diff, DiffEntry, DiffKind, DiffOptions};
 pub use crate::entry::Entry;
 pub use crate::errors::Error;
 pub use crate::excludes::{Exclude, ExcludeBuilder};
+pub use crate::export_tar::{export_tar, ExportTarOptions};
 pub use crate::gc_lock::GarbageCollectionLock;
 pub use crate::index::{IndexEntry, IndexRead, IndexWriter};
-pub use crate::kind::Kind;
+pub use crate::kind::{DeviceNumber, Kind};
 pub use crate::live_tree::{LiveEntry, LiveTree};
+pub use crate::manifest::{verify_manifest, write_manifest, ManifestKey, ManifestReport};
 pub use crate::merge::{MergeTrees, MergedEntryKind};
 pub use crate::misc::bytes_to_human_mb;
-pub use crate::restore::{restore, RestoreOptions, RestoreTree};
-pub use crate::show::{show_diff, show_versions, ShowVersionsOptions};
-pub use crate::stats::{BackupStats, DeleteStats, RestoreStats, ValidateStats};
+#[cfg(feature = "fuse")]
+pub use crate::mount::mount;
+pub use crate::observer::Observer;
+pub use crate::prune::{bands_to_prune, RetentionPolicy};
+pub use crate::restore::{restore, restore_to_writer, Normalization, RestoreOptions, RestoreTree};
+pub use crate::selftest::selftest;
+pub use crate::show::{
+    show_band_info, show_diff, show_versions, show_versions_json, ShowVersionsOptions,
+};
+pub use crate::stats::{
+    ArchiveStats, BackupStats, CheckSourceStats, DeleteStats, RestoreStats, ValidateStats,
+};
 pub use crate::stored_tree::StoredTree;
 pub use crate::transport::{open_transport, Transport};
 pub use crate::tree::{ReadBlocks, ReadTree, TreeSize};
-pub use crate::validate::ValidateOptions;
+pub use crate::validate::{DamagedFile, ValidateOptions, ValidateReport};
 
 pub type Result<T> = std::result::Result<T, Error>;
 
@@ -86,6 +111,11 @@ pub fn version() -> &'static str {
 /// (This might be older than the program version.)
 pub const ARCHIVE_VERSION: &str = "0.6";
 
+/// Archive version written instead of `ARCHIVE_VERSION` when the archive uses
+/// features that versions of Conserve before 0.6.17 can't read, so that they
+/// refuse to open it rather than misreading it.
+pub const EXTENDED_ARCHIVE_VERSION: &str = "0.6.17";
+
 pub const SYMLINKS_SUPPORTED: bool = cfg!(target_family = "unix");
 
 /// Break blocks at this many uncompressed bytes.
@@ -97,6 +127,10 @@ const SMALL_FILE_CAP: u64 = 100_000;
 /// Target maximum uncompressed size for combined blocks.
 const TARGET_COMBINED_BLOCK_SIZE: usize = MAX_BLOCK_SIZE;
 
+/// Most uncompressed block data that backup holds in memory while waiting to
+/// store it in parallel, however many threads there are.
+const MAX_PENDING_BLOCK_BYTES: usize = 64 << 20;
+
 /// ISO timestamp, for https://docs.rs/chrono/0.4.11/chrono/format/strftime/.
 const TIMESTAMP_FORMAT: &str = "%F %T";
 
@@ -26,6 +26,13 @@ use crate::*;
 #[derive(Clone)]
 pub struct LiveTree {
     path: PathBuf,
+
+    /// Don't descend into directories on a different filesystem from the
+    /// root.
+    one_file_system: bool,
+
+    /// Print the name of each cache directory that's skipped.
+    print_cache_dirs: bool,
 }
 
 impl LiveTree {
@@ -34,9 +41,35 @@ impl LiveTree {
         // TODO: Maybe fail here if the root doesn't exist or isn't a directory?
         Ok(LiveTree {
             path: path.as_ref().to_path_buf(),
+            one_file_system: false,
+            print_cache_dirs: false,
         })
     }
 
+    /// Set whether to stay on the filesystem containing the root, like
+    /// `tar --one-file-system`.
+    ///
+    /// Directories that are mount points for some other filesystem are still
+    /// included, but not their contents. This has no effect on platforms that
+    /// don't report device ids.
+    #[must_use]
+    pub fn with_one_file_system(self, one_file_system: bool) -> LiveTree {
+        LiveTree {
+            one_file_system,
+            ..self
+        }
+    }
+
+    /// Set whether to print the name of each directory that's skipped because
+    /// it contains a `CACHEDIR.TAG`.
+    #[must_use]
+    pub fn with_print_cache_dirs(self, print_cache_dirs: bool) -> LiveTree {
+        LiveTree {
+            print_cache_dirs,
+            ..self
+        }
+    }
+
     fn relative_path(&self, apath: &Apath) -> PathBuf {
         apath.below(&self.path)
     }
@@ -55,6 +88,10 @@ pub struct LiveEntry {
     mtime: UnixTime,
     size: Option<u64>,
     symlink_target: Option<String>,
+    unix_mode: Option<u32>,
+    uid: Option<u32>,
+    gid: Option<u32>,
+    device: Option<DeviceNumber>,
 }
 
 impl tree::ReadTree for LiveTree {
@@ -63,7 +100,13 @@ impl tree::ReadTree for LiveTree {
     type IT = Iter;
 
     fn iter_entries(&self, subtree: Apath, exclude: Exclude) -> Result<Self::IT> {
-        Iter::new(&self.path, subtree, exclude)
+        Iter::new(
+            &self.path,
+            subtree,
+            exclude,
+            self.one_file_system,
+            self.print_cache_dirs,
+        )
     }
 
     fn file_contents(&self, entry: &LiveEntry) -> Result<Self::R> {
@@ -102,6 +145,22 @@ impl Entry for LiveEntry {
     fn symlink_target(&self) -> &Option<String> {
         &self.symlink_target
     }
+
+    fn unix_mode(&self) -> Option<u32> {
+        self.unix_mode
+    }
+
+    fn uid(&self) -> Option<u32> {
+        self.uid
+    }
+
+    fn gid(&self) -> Option<u32> {
+        self.gid
+    }
+
+    fn device(&self) -> Option<DeviceNumber> {
+        self.device
+    }
 }
 
 impl LiveEntry {
@@ -120,16 +179,67 @@ impl LiveEntry {
         } else {
             None
         };
+        let (unix_mode, uid, gid) = unix_permissions(metadata);
+        let kind: Kind = metadata.file_type().into();
+        let device = if kind.is_device() {
+            device_number(metadata)
+        } else {
+            None
+        };
         LiveEntry {
             apath,
-            kind: metadata.file_type().into(),
+            kind,
             mtime,
             symlink_target,
             size,
+            unix_mode,
+            uid,
+            gid,
+            device,
         }
     }
 }
 
+/// Return the permission bits, uid, and gid of a file.
+#[cfg(unix)]
+fn unix_permissions(metadata: &fs::Metadata) -> (Option<u32>, Option<u32>, Option<u32>) {
+    use std::os::unix::fs::MetadataExt;
+    (
+        Some(metadata.mode() & 0o7777),
+        Some(metadata.uid()),
+        Some(metadata.gid()),
+    )
+}
+
+#[cfg(not(unix))]
+fn unix_permissions(_metadata: &fs::Metadata) -> (Option<u32>, Option<u32>, Option<u32>) {
+    (None, None, None)
+}
+
+/// Return the id of the device holding a file.
+#[cfg(unix)]
+fn device_id(metadata: &fs::Metadata) -> Option<u64> {
+    use std::os::unix::fs::MetadataExt;
+    Some(metadata.dev())
+}
+
+#[cfg(not(unix))]
+fn device_id(_metadata: &fs::Metadata) -> Option<u64> {
+    None
+}
+
+/// Return the device that a device node refers to.
+#[cfg(unix)]
+fn device_number(metadata: &fs::Metadata) -> Option<DeviceNumber> {
+    use std::os::unix::fs::MetadataExt;
+    Some(DeviceNumber::from_rdev(metadata.rdev()))
+}
+
+#[cfg(not(unix))]
+fn device_number(_metadata: &fs::Metadata) -> Option<DeviceNumber> {
+    None
+}
+
 /// Recursive iterator of the contents of a live tree.
 ///
 /// Iterate source files descending through a source directory.
@@ -156,14 +266,31 @@ pub struct Iter {
     /// Patterns to exclude from iteration.
     exclude: Exclude,
 
+    /// If set, don't descend into directories on other devices.
+    root_device: Option<u64>,
+
+    /// Print the name of each cache directory that's skipped.
+    print_cache_dirs: bool,
+
     stats: LiveTreeIterStats,
 }
 
 impl Iter {
     /// Construct a new iter that will visit everything below this root path,
     /// subject to some exclusions
-    fn new(root_path: &Path, subtree: Apath, exclude: Exclude) -> Result<Iter> {
+    fn new(
+        root_path: &Path,
+        subtree: Apath,
+        exclude: Exclude,
+        one_file_system: bool,
+        print_cache_dirs: bool,
+    ) -> Result<Iter> {
         let start_metadata = fs::symlink_metadata(&subtree.below(root_path))?;
+        let root_device = if one_file_system {
+            device_id(&fs::symlink_metadata(root_path)?)
+        } else {
+            None
+        };
         // Preload iter to return the root and then recurse into it.
         let entry_deque: VecDeque<LiveEntry> = [LiveEntry::from_fs_metadata(
             subtree.clone(),
@@ -180,10 +307,17 @@ impl Iter {
             dir_deque,
             check_order: apath::DebugCheckOrder::new(),
             exclude,
+            root_device,
+            print_cache_dirs,
             stats: LiveTreeIterStats::default(),
         })
     }
 
+    /// Return counts of what's been seen so far.
+    pub fn stats(&self) -> &LiveTreeIterStats {
+        &self.stats
+    }
+
     /// Visit the next directory.
     ///
     /// Any errors occurring are logged but not returned; we'll continue to
@@ -197,6 +331,7 @@ impl Iter {
             Ok(i) => i,
             Err(e) => {
                 ui::problem(&format!("Error reading directory {:?}: {}", &dir_path, e));
+                self.stats.unreadable_directories += 1;
                 return;
             }
         };
@@ -241,10 +376,15 @@ impl Iter {
                 }
             };
             if ft.is_dir() {
-                // TODO: Count them?
                 // TODO: Perhaps an option to back them up anyhow?
                 match cachedir::is_tagged(&dir_entry.path()) {
-                    Ok(true) => continue,
+                    Ok(true) => {
+                        self.stats.cache_dirs += 1;
+                        if self.print_cache_dirs {
+                            ui::println(&format!("Skipped cache directory {}", child_apath));
+                        }
+                        continue;
+                    }
                     Ok(false) => (),
                     Err(e) => {
                         ui::problem(&format!(
@@ -306,7 +446,12 @@ impl Iter {
                 None
             };
             if ft.is_dir() {
-                subdir_apaths.push(child_apath.clone());
+                if self.root_device.is_some() && device_id(&metadata) != self.root_device {
+                    // Keep the mount point, but not its contents.
+                    self.stats.other_filesystems += 1;
+                } else {
+                    subdir_apaths.push(child_apath.clone());
+                }
             }
             children.push((
                 child_name.to_string(),
@@ -0,0 +1,421 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Signed manifests, which make changes to an archive detectable.
+//!
+//! A signed archive has a `MANIFEST` file in its top directory, which lists
+//! every block, and the SHA-256 of the archive header and of every file in
+//! every band, along with an HMAC-SHA256 of that list. The manifest is
+//! rewritten after each command that changes the archive.
+//!
+//! The key is either the contents of a key file, or derived from a
+//! passphrase using PBKDF2 with a salt stored in the archive header.
+
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt;
+use std::fs;
+use std::path::Path;
+
+use hmac::{Hmac, Mac};
+use rayon::prelude::*;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::archive::HEADER_FILENAME;
+use crate::transport::Transport;
+use crate::*;
+
+/// Name of the manifest file in the top directory of the archive.
+pub(crate) const MANIFEST_FILENAME: &str = "MANIFEST";
+
+/// Number of PBKDF2 rounds used to derive a key from a passphrase.
+const PASSPHRASE_ROUNDS: u32 = 100_000;
+
+/// A secret key that signs and checks an archive's manifest.
+#[derive(Clone)]
+pub struct ManifestKey {
+    key: Vec<u8>,
+}
+
+impl fmt::Debug for ManifestKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        // Don't show the key in logs or error messages.
+        f.write_str("ManifestKey(..)")
+    }
+}
+
+impl ManifestKey {
+    /// Use the entire contents of a file as the key.
+    pub fn from_file(path: &Path) -> Result<ManifestKey> {
+        let key = fs::read(path).map_err(|source| Error::ReadKeyFile {
+            path: path.to_owned(),
+            source,
+        })?;
+        if key.is_empty() {
+            return Err(Error::EmptyKeyFile {
+                path: path.to_owned(),
+            });
+        }
+        Ok(ManifestKey { key })
+    }
+
+    /// Derive a key from a passphrase and the salt in the archive header.
+    ///
+    /// Returns `Err(Error::ArchiveNotSigned)` if the archive has no salt.
+    pub fn from_passphrase(archive: &Archive, passphrase: &str) -> Result<ManifestKey> {
+        let salt = archive.manifest_salt().ok_or(Error::ArchiveNotSigned)?;
+        let mut key = vec![0; 32];
+        pbkdf2::pbkdf2::<Hmac<Sha256>>(
+            passphrase.as_bytes(),
+            salt.as_bytes(),
+            PASSPHRASE_ROUNDS,
+            &mut key,
+        );
+        Ok(ManifestKey { key })
+    }
+
+    fn mac(&self) -> Hmac<Sha256> {
+        Hmac::new_from_slice(&self.key).expect("HMAC accepts keys of any length")
+    }
+}
+
+/// Make a new random salt, as a hex string.
+pub(crate) fn generate_salt() -> Result<String> {
+    let mut salt = [0u8; 16];
+    getrandom::getrandom(&mut salt).map_err(|err| Error::GenerateSalt { source: err.into() })?;
+    Ok(hex::encode(salt))
+}
+
+/// Everything in an archive that's covered by the signature.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct ManifestContents {
+    /// Hex SHA-256 of the header and each band file, by relative path.
+    files: BTreeMap<String, String>,
+    /// Names of all the blocks.
+    blocks: BTreeSet<String>,
+}
+
+impl ManifestContents {
+    /// Read the archive's current contents.
+    fn from_archive(archive: &Archive) -> Result<ManifestContents> {
+        let transport = archive.transport();
+        let mut paths = vec![HEADER_FILENAME.to_owned()];
+        for band_id in archive.list_band_ids()? {
+            list_files(transport, &band_id.to_string(), &mut paths)?;
+        }
+        let mut files = BTreeMap::new();
+        for path in paths {
+            let content = transport.read_file(&path)?;
+            files.insert(path, hex::encode(Sha256::digest(&content)));
+        }
+        let blocks = archive
+            .block_dir()
+            .block_names()?
+            .map(|hash| hash.to_string())
+            .collect();
+        Ok(ManifestContents { files, blocks })
+    }
+
+    /// Return the hex HMAC of the serialized contents.
+    fn sign(&self, key: &ManifestKey) -> Result<String> {
+        let mut mac = key.mac();
+        mac.update(&self.to_json()?);
+        Ok(hex::encode(mac.finalize().into_bytes()))
+    }
+
+    /// True if `signature` is the correct hex HMAC of the contents.
+    fn check_signature(&self, key: &ManifestKey, signature: &str) -> Result<bool> {
+        let signature = match hex::decode(signature) {
+            Ok(signature) => signature,
+            Err(_) => return Ok(false),
+        };
+        let mut mac = key.mac();
+        mac.update(&self.to_json()?);
+        Ok(mac.verify_slice(&signature).is_ok())
+    }
+
+    fn to_json(&self) -> Result<Vec<u8>> {
+        serde_json::to_vec(self).map_err(|source| Error::SerializeJson {
+            path: MANIFEST_FILENAME.to_owned(),
+            source,
+        })
+    }
+}
+
+/// Add the paths of all files under `dir` to `paths`.
+fn list_files(transport: &dyn Transport, dir: &str, paths: &mut Vec<String>) -> Result<()> {
+    let names = transport.list_dir_names(dir)?;
+    for file in names.files {
+        paths.push(format!("{}/{}", dir, file));
+    }
+    for subdir in names.dirs {
+        list_files(transport, &format!("{}/{}", dir, subdir), paths)?;
+    }
+    Ok(())
+}
+
+/// The manifest file.
+#[derive(Debug, Serialize, Deserialize)]
+struct Manifest {
+    #[serde(flatten)]
+    contents: ManifestContents,
+    /// Hex HMAC-SHA256 of the JSON serialization of the contents.
+    hmac: String,
+}
+
+/// Write a new signed manifest describing everything now in the archive.
+pub fn write_manifest(archive: &Archive, key: &ManifestKey) -> Result<()> {
+    let contents = ManifestContents::from_archive(archive)?;
+    let hmac = contents.sign(key)?;
+    let json = serde_json::to_vec(&Manifest { contents, hmac }).map_err(|source| {
+        Error::SerializeJson {
+            path: MANIFEST_FILENAME.to_owned(),
+            source,
+        }
+    })?;
+    archive
+        .transport()
+        .write_file_durably(MANIFEST_FILENAME, &json)
+        .map_err(|source| Error::WriteMetadata {
+            path: MANIFEST_FILENAME.to_owned(),
+            source,
+        })
+}
+
+/// The result of checking an archive against its manifest.
+#[derive(Debug, Default, Clone, Eq, PartialEq, Serialize)]
+pub struct ManifestReport {
+    /// True if the manifest is correctly signed by the key. If not, the other
+    /// results can't be trusted.
+    pub signature_ok: bool,
+    /// Number of files listed in the manifest.
+    pub files: usize,
+    /// Number of blocks listed in the manifest.
+    pub blocks: usize,
+    /// Files whose content doesn't match the manifest.
+    pub changed_files: Vec<String>,
+    /// Files in the manifest that are no longer in the archive.
+    pub missing_files: Vec<String>,
+    /// Files in the archive that aren't in the manifest.
+    pub unlisted_files: Vec<String>,
+    /// Blocks in the manifest that are no longer in the archive.
+    pub missing_blocks: Vec<String>,
+    /// Blocks in the archive that aren't in the manifest.
+    pub unlisted_blocks: Vec<String>,
+    /// Blocks whose content doesn't match their name.
+    pub damaged_blocks: Vec<String>,
+}
+
+impl ManifestReport {
+    /// True if the archive doesn't exactly match a correctly signed
+    /// manifest.
+    pub fn has_problems(&self) -> bool {
+        !self.signature_ok
+            || !self.changed_files.is_empty()
+            || !self.missing_files.is_empty()
+            || !self.unlisted_files.is_empty()
+            || !self.missing_blocks.is_empty()
+            || !self.unlisted_blocks.is_empty()
+            || !self.damaged_blocks.is_empty()
+    }
+}
+
+/// Check the manifest's signature, and check that the archive contains
+/// exactly the files and blocks it lists, with the right content.
+///
+/// Each problem is reported through the UI as it's found, and also returned
+/// in the report.
+pub fn verify_manifest(archive: &Archive, key: &ManifestKey) -> Result<ManifestReport> {
+    let json = archive
+        .transport()
+        .read_file(MANIFEST_FILENAME)
+        .map_err(|source| Error::ReadManifest { source })?;
+    let manifest: Manifest =
+        serde_json::from_slice(&json).map_err(|source| Error::DeserializeJson {
+            path: MANIFEST_FILENAME.into(),
+            source,
+        })?;
+    let listed = manifest.contents;
+    let mut report = ManifestReport {
+        signature_ok: listed.check_signature(key, &manifest.hmac)?,
+        files: listed.files.len(),
+        blocks: listed.blocks.len(),
+        ..ManifestReport::default()
+    };
+    if !report.signature_ok {
+        ui::problem("Manifest signature is wrong: the manifest was changed, or the key is wrong");
+    }
+
+    let actual = ManifestContents::from_archive(archive)?;
+    for (path, hash) in &listed.files {
+        match actual.files.get(path) {
+            None => {
+                ui::problem(&format!("File in manifest is missing: {}", path));
+                report.missing_files.push(path.clone());
+            }
+            Some(actual_hash) if actual_hash != hash => {
+                ui::problem(&format!("File doesn't match manifest: {}", path));
+                report.changed_files.push(path.clone());
+            }
+            Some(_) => (),
+        }
+    }
+    for path in actual.files.keys() {
+        if !listed.files.contains_key(path) {
+            ui::problem(&format!("File isn't in manifest: {}", path));
+            report.unlisted_files.push(path.clone());
+        }
+    }
+    for name in listed.blocks.difference(&actual.blocks) {
+        ui::problem(&format!("Block in manifest is missing: {}", name));
+        report.missing_blocks.push(name.clone());
+    }
+    for name in actual.blocks.difference(&listed.blocks) {
+        ui::problem(&format!("Block isn't in manifest: {}", name));
+        report.unlisted_blocks.push(name.clone());
+    }
+
+    let block_dir = archive.block_dir();
+    let present: Vec<&String> = listed.blocks.intersection(&actual.blocks).collect();
+    report.damaged_blocks = present
+        .into_par_iter()
+        .filter(|name| match name.parse::<BlockHash>() {
+            Ok(hash) => block_dir.get_block_content(&hash).is_err(),
+            Err(_) => true,
+        })
+        .cloned()
+        .collect();
+    report.damaged_blocks.sort();
+    for name in &report.damaged_blocks {
+        ui::problem(&format!("Block is damaged: {}", name));
+    }
+    Ok(report)
+}
+
+#[cfg(test)]
+mod test {
+    use std::fs;
+
+    use tempfile::TempDir;
+
+    use super::*;
+    use crate::test_fixtures::TreeFixture;
+
+    fn signed_archive() -> (TempDir, Archive, ManifestKey) {
+        let temp = TempDir::new().unwrap();
+        let archive = Archive::create_with_options(
+            Box::new(crate::transport::local::LocalTransport::new(temp.path())),
+            &ArchiveOptions {
+                signed: true,
+                ..ArchiveOptions::default()
+            },
+        )
+        .unwrap();
+        assert!(archive.is_signed());
+        let key = ManifestKey::from_passphrase(&archive, "correct horse").unwrap();
+        let srcdir = TreeFixture::new();
+        srcdir.create_file_with_contents("hello", b"hello world");
+        backup(&archive, &srcdir.live_tree(), &BackupOptions::default()).unwrap();
+        write_manifest(&archive, &key).unwrap();
+        (temp, archive, key)
+    }
+
+    fn block_path(temp: &TempDir, archive: &Archive) -> std::path::PathBuf {
+        let name = archive
+            .block_dir()
+            .block_names()
+            .unwrap()
+            .next()
+            .unwrap()
+            .to_string();
+        temp.path().join("d").join(&name[..3]).join(name)
+    }
+
+    #[test]
+    fn unchanged_archive_verifies() {
+        let (_temp, archive, key) = signed_archive();
+        let report = verify_manifest(&archive, &key).unwrap();
+        assert!(!report.has_problems(), "{:?}", report);
+        assert_eq!(report.blocks, 1);
+        // The header, and the band head, tail, and one index hunk.
+        assert_eq!(report.files, 4);
+    }
+
+    #[test]
+    fn wrong_key_fails_signature() {
+        let (_temp, archive, _key) = signed_archive();
+        let key = ManifestKey::from_passphrase(&archive, "wrong").unwrap();
+        let report = verify_manifest(&archive, &key).unwrap();
+        assert!(!report.signature_ok);
+        assert!(report.has_problems());
+    }
+
+    #[test]
+    fn edited_manifest_fails_signature() {
+        let (temp, archive, key) = signed_archive();
+        let manifest_path = temp.path().join(MANIFEST_FILENAME);
+        let json = fs::read_to_string(&manifest_path).unwrap();
+        let block_name = archive.block_dir().block_names().unwrap().next().unwrap();
+        fs::write(
+            &manifest_path,
+            json.replace(&block_name.to_string(), &"0".repeat(128)),
+        )
+        .unwrap();
+        let report = verify_manifest(&archive, &key).unwrap();
+        assert!(!report.signature_ok);
+    }
+
+    #[test]
+    fn removed_and_added_blocks_are_detected() {
+        let (temp, archive, key) = signed_archive();
+        let path = block_path(&temp, &archive);
+        let content = fs::read(&path).unwrap();
+        fs::remove_file(&path).unwrap();
+        // Store a different, valid block that's not in the manifest.
+        let other_name = "0".repeat(128);
+        let other_dir = temp.path().join("d").join(&other_name[..3]);
+        fs::create_dir_all(&other_dir).unwrap();
+        fs::write(other_dir.join(&other_name), content).unwrap();
+
+        let report = verify_manifest(&archive, &key).unwrap();
+        assert!(report.signature_ok);
+        assert_eq!(report.missing_blocks.len(), 1);
+        assert_eq!(report.unlisted_blocks, [other_name]);
+    }
+
+    #[test]
+    fn damaged_block_and_changed_band_file_are_detected() {
+        let (temp, archive, key) = signed_archive();
+        fs::write(block_path(&temp, &archive), b"garbage").unwrap();
+        let tail_path = temp.path().join("b0000").join("BANDTAIL");
+        let mut tail = fs::read(&tail_path).unwrap();
+        tail.push(b' ');
+        fs::write(&tail_path, tail).unwrap();
+
+        let report = verify_manifest(&archive, &key).unwrap();
+        assert!(report.signature_ok);
+        assert_eq!(report.damaged_blocks.len(), 1);
+        assert_eq!(report.changed_files, ["b0000/BANDTAIL"]);
+    }
+
+    #[test]
+    fn passphrase_needs_signed_archive() {
+        let temp = TempDir::new().unwrap();
+        let archive = Archive::create_path(temp.path()).unwrap();
+        assert!(!archive.is_signed());
+        assert!(matches!(
+            ManifestKey::from_passphrase(&archive, "secret"),
+            Err(Error::ArchiveNotSigned)
+        ));
+    }
+}
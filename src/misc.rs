@@ -29,6 +29,39 @@ pub fn bytes_to_human_mb(s: u64) -> String {
     s
 }
 
+/// Parse a number of bytes such as `500KB`, `2MB`, `4KiB`, or `1000000`.
+///
+/// `KB`, `MB`, and `GB` are decimal multipliers; `KiB`, `MiB`, and `GiB` are
+/// binary.
+pub fn parse_bytes(s: &str) -> std::result::Result<u64, String> {
+    let s = s.trim();
+    let upper = s.to_ascii_uppercase();
+    let (number, multiplier) = if let Some(number) = upper.strip_suffix("KIB") {
+        (number, 1 << 10)
+    } else if let Some(number) = upper.strip_suffix("MIB") {
+        (number, 1 << 20)
+    } else if let Some(number) = upper.strip_suffix("GIB") {
+        (number, 1 << 30)
+    } else if let Some(number) = upper.strip_suffix("KB") {
+        (number, 1_000)
+    } else if let Some(number) = upper.strip_suffix("MB") {
+        (number, 1_000_000)
+    } else if let Some(number) = upper.strip_suffix("GB") {
+        (number, 1_000_000_000)
+    } else if let Some(number) = upper.strip_suffix('B') {
+        (number, 1)
+    } else {
+        (upper.as_str(), 1)
+    };
+    let number: u64 = number
+        .trim()
+        .parse()
+        .map_err(|_| format!("Invalid size {:?}: expected a number like 500KB or 2MB", s))?;
+    number
+        .checked_mul(multiplier)
+        .ok_or_else(|| format!("Size {:?} is too large", s))
+}
+
 /// True if `a` is zero.
 ///
 /// This trivial function exists as a predicate for serde.
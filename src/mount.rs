@@ -0,0 +1,408 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Mount a stored tree as a read-only FUSE filesystem.
+//!
+//! The names and metadata of all the entries in the tree are read into memory
+//! when it's mounted, and numbered as inodes in apath order. File content is
+//! only read from the archive when it's needed, and a few recently used blocks
+//! are cached, so that sequential reads don't decompress the same block
+//! repeatedly.
+//!
+//! The filesystem is mounted read-only, so the kernel refuses any change with
+//! `EROFS` before it reaches Conserve.
+//!
+//! This is only built with the `fuse` feature, because it needs libfuse.
+
+use std::collections::{HashMap, VecDeque};
+use std::ffi::OsStr;
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::thread::sleep;
+use std::time::{Duration, UNIX_EPOCH};
+
+use fuser::{
+    FileAttr, FileType, Filesystem, MountOption, ReplyAttr, ReplyData, ReplyDirectory, ReplyEntry,
+    ReplyOpen, Request, FUSE_ROOT_ID,
+};
+
+use crate::*;
+
+/// How long the kernel may cache names and attributes: the tree never
+/// changes, so this can be long.
+const TTL: Duration = Duration::from_secs(3600);
+
+/// Number of decompressed blocks to keep in memory.
+const BLOCK_CACHE_SIZE: usize = 16;
+
+/// Mount a stored tree at `mountpoint`, and serve it until interrupted by
+/// SIGINT or SIGTERM, or until it's unmounted.
+pub fn mount(
+    archive: &Archive,
+    mountpoint: &Path,
+    band_selection: BandSelectionPolicy,
+) -> Result<()> {
+    let st = archive.open_stored_tree(band_selection)?;
+    let mountpoint_metadata = std::fs::metadata(mountpoint)?;
+    let fs = ArchiveFs::new(
+        &st,
+        archive.block_dir().clone(),
+        mountpoint_metadata.uid(),
+        mountpoint_metadata.gid(),
+    )?;
+    let options = [
+        MountOption::RO,
+        MountOption::FSName("conserve".to_owned()),
+        MountOption::DefaultPermissions,
+    ];
+    let session = fuser::spawn_mount2(fs, mountpoint, &options).map_err(|source| Error::Mount {
+        path: mountpoint.to_owned(),
+        source,
+    })?;
+    let interrupted = Arc::new(AtomicBool::new(false));
+    for signal in [signal_hook::consts::SIGINT, signal_hook::consts::SIGTERM] {
+        signal_hook::flag::register(signal, Arc::clone(&interrupted))?;
+    }
+    ui::println(&format!(
+        "Mounted {} on {}; interrupt to unmount",
+        st.band().id(),
+        mountpoint.display()
+    ));
+    while !interrupted.load(Ordering::Relaxed) && !session.guard.is_finished() {
+        sleep(Duration::from_millis(100));
+    }
+    // Dropping the session unmounts the filesystem, if it's still mounted.
+    drop(session);
+    Ok(())
+}
+
+/// An entry in the mounted tree.
+struct Node {
+    entry: IndexEntry,
+    /// For directories, the names and inodes of children, in order.
+    children: Vec<(String, u64)>,
+    /// Inode of the directory containing this one; the root is its own parent.
+    parent: u64,
+}
+
+/// A stored tree, presented as a FUSE filesystem.
+struct ArchiveFs {
+    /// Nodes indexed by inode number minus 1, so the root is at 0.
+    nodes: Vec<Node>,
+    block_dir: BlockDir,
+    blocks: BlockCache,
+    /// Owner for entries that don't record one.
+    default_uid: u32,
+    default_gid: u32,
+}
+
+impl ArchiveFs {
+    fn new(
+        st: &StoredTree,
+        block_dir: BlockDir,
+        default_uid: u32,
+        default_gid: u32,
+    ) -> Result<Self> {
+        let mut nodes: Vec<Node> = Vec::new();
+        let mut dir_inodes: HashMap<String, u64> = HashMap::new();
+        for entry in st.iter_entries(Apath::root(), Exclude::nothing())? {
+            if entry.kind() == Kind::Unknown {
+                continue;
+            }
+            let ino = nodes.len() as u64 + 1;
+            let mut parent_ino = FUSE_ROOT_ID;
+            if entry.apath() == "/" {
+                debug_assert_eq!(ino, FUSE_ROOT_ID);
+            } else {
+                // Parents always come before their children in apath order.
+                let (parent, name) = entry.apath().rsplit_once('/').expect("apath has a slash");
+                let parent = if parent.is_empty() { "/" } else { parent };
+                match dir_inodes.get(parent) {
+                    Some(&dir_ino) => {
+                        nodes[dir_ino as usize - 1]
+                            .children
+                            .push((name.to_owned(), ino));
+                        parent_ino = dir_ino;
+                    }
+                    None => {
+                        ui::problem(&format!("No parent directory for {}", entry.apath()));
+                        continue;
+                    }
+                }
+            }
+            if entry.kind() == Kind::Dir {
+                dir_inodes.insert(entry.apath().to_string(), ino);
+            }
+            nodes.push(Node {
+                entry,
+                children: Vec::new(),
+                parent: parent_ino,
+            });
+        }
+        Ok(ArchiveFs {
+            nodes,
+            block_dir,
+            blocks: BlockCache::default(),
+            default_uid,
+            default_gid,
+        })
+    }
+
+    fn node(&self, ino: u64) -> Option<&Node> {
+        ino.checked_sub(1)
+            .and_then(|index| self.nodes.get(index as usize))
+    }
+
+    fn lookup_child(&self, parent: u64, name: &OsStr) -> Option<u64> {
+        let name = name.to_str()?;
+        self.node(parent)?
+            .children
+            .iter()
+            .find(|(child_name, _)| child_name == name)
+            .map(|(_, ino)| *ino)
+    }
+
+    fn attr(&self, ino: u64) -> Option<FileAttr> {
+        let entry = &self.node(ino)?.entry;
+        let (kind, size, default_perm, nlink) = match entry.kind() {
+            Kind::Dir => (FileType::Directory, 0, 0o755, 2),
+            Kind::File => (FileType::RegularFile, entry.size().unwrap_or(0), 0o644, 1),
+            Kind::Symlink => (
+                FileType::Symlink,
+                entry
+                    .target
+                    .as_ref()
+                    .map_or(0, |target| target.len() as u64),
+                0o777,
+                1,
+            ),
+            Kind::Fifo => (FileType::NamedPipe, 0, 0o644, 1),
+            Kind::BlockDevice => (FileType::BlockDevice, 0, 0o600, 1),
+            Kind::CharDevice => (FileType::CharDevice, 0, 0o600, 1),
+            Kind::Unknown => return None,
+        };
+        let mtime = if entry.mtime >= 0 {
+            UNIX_EPOCH + Duration::new(entry.mtime as u64, entry.mtime_nanos)
+        } else {
+            UNIX_EPOCH
+        };
+        Some(FileAttr {
+            ino,
+            size,
+            blocks: (size + 511) / 512,
+            atime: mtime,
+            mtime,
+            ctime: mtime,
+            crtime: mtime,
+            kind,
+            perm: (entry.unix_mode.unwrap_or(default_perm) & 0o7777) as u16,
+            nlink,
+            uid: entry.uid.unwrap_or(self.default_uid),
+            gid: entry.gid.unwrap_or(self.default_gid),
+            rdev: entry.device.map_or(0, |device| device.rdev() as u32),
+            blksize: 4096,
+            flags: 0,
+        })
+    }
+
+    /// Read up to `size` bytes of a file starting at `offset`, loading only
+    /// the blocks that overlap that range.
+    fn read_range(&mut self, ino: u64, offset: u64, size: u64) -> Result<Vec<u8>> {
+        let end = offset.saturating_add(size);
+        let addrs = match self.node(ino) {
+            Some(node) => node.entry.addrs.clone(),
+            None => return Ok(Vec::new()),
+        };
+        let mut buf = Vec::new();
+        // Position in the file of the start of the current address.
+        let mut pos = 0;
+        for addr in addrs {
+            let addr_end = pos + addr.len;
+            if addr_end > offset && pos < end {
+                let content = self.blocks.get(&self.block_dir, &addr.hash)?;
+                let from = (addr.start + offset.saturating_sub(pos)) as usize;
+                let to = (addr.start + end.min(addr_end) - pos) as usize;
+                if to > content.len() {
+                    return Err(Error::AddressTooLong {
+                        address: addr,
+                        actual_len: content.len(),
+                    });
+                }
+                buf.extend_from_slice(&content[from..to]);
+            }
+            if addr_end >= end {
+                break;
+            }
+            pos = addr_end;
+        }
+        Ok(buf)
+    }
+}
+
+impl Filesystem for ArchiveFs {
+    fn lookup(&mut self, _req: &Request<'_>, parent: u64, name: &OsStr, reply: ReplyEntry) {
+        match self
+            .lookup_child(parent, name)
+            .and_then(|ino| self.attr(ino))
+        {
+            Some(attr) => reply.entry(&TTL, &attr, 0),
+            None => reply.error(libc::ENOENT),
+        }
+    }
+
+    fn getattr(&mut self, _req: &Request<'_>, ino: u64, reply: ReplyAttr) {
+        match self.attr(ino) {
+            Some(attr) => reply.attr(&TTL, &attr),
+            None => reply.error(libc::ENOENT),
+        }
+    }
+
+    fn readlink(&mut self, _req: &Request<'_>, ino: u64, reply: ReplyData) {
+        match self.node(ino).and_then(|node| node.entry.target.as_ref()) {
+            Some(target) => reply.data(target.as_bytes()),
+            None => reply.error(libc::EINVAL),
+        }
+    }
+
+    fn open(&mut self, _req: &Request<'_>, ino: u64, flags: i32, reply: ReplyOpen) {
+        if flags & libc::O_ACCMODE != libc::O_RDONLY {
+            reply.error(libc::EROFS)
+        } else if self.node(ino).is_none() {
+            reply.error(libc::ENOENT)
+        } else {
+            reply.opened(0, 0)
+        }
+    }
+
+    fn read(
+        &mut self,
+        _req: &Request<'_>,
+        ino: u64,
+        _fh: u64,
+        offset: i64,
+        size: u32,
+        _flags: i32,
+        _lock_owner: Option<u64>,
+        reply: ReplyData,
+    ) {
+        match self.read_range(ino, offset.max(0) as u64, size.into()) {
+            Ok(data) => reply.data(&data),
+            Err(err) => {
+                ui::show_error(&err);
+                reply.error(libc::EIO)
+            }
+        }
+    }
+
+    fn readdir(
+        &mut self,
+        _req: &Request<'_>,
+        ino: u64,
+        _fh: u64,
+        offset: i64,
+        mut reply: ReplyDirectory,
+    ) {
+        let node = match self.node(ino) {
+            Some(node) if node.entry.kind() == Kind::Dir => node,
+            Some(_) => return reply.error(libc::ENOTDIR),
+            None => return reply.error(libc::ENOENT),
+        };
+        let mut entries = vec![
+            (ino, FileType::Directory, "."),
+            (node.parent, FileType::Directory, ".."),
+        ];
+        for (name, child) in &node.children {
+            if let Some(attr) = self.attr(*child) {
+                entries.push((*child, attr.kind, name.as_str()));
+            }
+        }
+        // Each entry gives the offset of the one after it.
+        for (i, (ino, kind, name)) in entries.into_iter().enumerate().skip(offset as usize) {
+            if reply.add(ino, (i + 1) as i64, kind, name) {
+                break;
+            }
+        }
+        reply.ok()
+    }
+}
+
+/// A small cache of recently used decompressed blocks.
+#[derive(Default)]
+struct BlockCache {
+    /// Most recently used first.
+    blocks: VecDeque<(BlockHash, Arc<Vec<u8>>)>,
+}
+
+impl BlockCache {
+    fn get(&mut self, block_dir: &BlockDir, hash: &BlockHash) -> Result<Arc<Vec<u8>>> {
+        if let Some(i) = self.blocks.iter().position(|(h, _)| h == hash) {
+            let found = self.blocks.remove(i).unwrap();
+            let content = Arc::clone(&found.1);
+            self.blocks.push_front(found);
+            return Ok(content);
+        }
+        let content = Arc::new(block_dir.get_block_content(hash)?.0);
+        self.blocks.push_front((hash.clone(), Arc::clone(&content)));
+        self.blocks.truncate(BLOCK_CACHE_SIZE);
+        Ok(content)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::test_fixtures::ScratchArchive;
+
+    fn archive_fs(af: &ScratchArchive) -> ArchiveFs {
+        let st = af.open_stored_tree(BandSelectionPolicy::Latest).unwrap();
+        ArchiveFs::new(&st, af.block_dir().clone(), 1000, 1000).unwrap()
+    }
+
+    #[test]
+    fn lookup_and_read_files() {
+        let af = ScratchArchive::new();
+        af.store_two_versions();
+        let mut fs = archive_fs(&af);
+
+        let subdir = fs.lookup_child(FUSE_ROOT_ID, OsStr::new("subdir")).unwrap();
+        assert_eq!(fs.attr(subdir).unwrap().kind, FileType::Directory);
+        let subfile = fs.lookup_child(subdir, OsStr::new("subfile")).unwrap();
+        let attr = fs.attr(subfile).unwrap();
+        assert_eq!(attr.kind, FileType::RegularFile);
+        assert_eq!(attr.size, 8);
+        assert!(fs
+            .lookup_child(FUSE_ROOT_ID, OsStr::new("nonexistent"))
+            .is_none());
+
+        assert_eq!(fs.read_range(subfile, 0, 100).unwrap(), b"contents");
+        assert_eq!(fs.read_range(subfile, 2, 3).unwrap(), b"nte");
+        assert_eq!(fs.read_range(subfile, 8, 10).unwrap(), b"");
+    }
+
+    #[test]
+    fn children_are_in_order() {
+        let af = ScratchArchive::new();
+        af.store_two_versions();
+        let fs = archive_fs(&af);
+        let names: Vec<&str> = fs
+            .node(FUSE_ROOT_ID)
+            .unwrap()
+            .children
+            .iter()
+            .map(|(name, _)| name.as_str())
+            .collect();
+        assert_eq!(names, ["hello", "hello2", "link", "subdir"]);
+    }
+}
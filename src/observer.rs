@@ -0,0 +1,50 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Callbacks that tell library users about the progress of a backup or
+//! restore.
+
+use std::fmt::Debug;
+
+use crate::*;
+
+/// Receives events as a backup or restore runs, for example to drive a
+/// progress display or to export metrics.
+///
+/// Set this as `observer` in `BackupOptions` or `RestoreOptions`. Every
+/// method does nothing by default, so implementations only need to provide
+/// the events they're interested in.
+///
+/// The methods are called on the thread doing the work, and no locks are
+/// held while they run, but the operation waits for them to return. They
+/// should be quick: anything slow should be handed off to another thread,
+/// for example through a channel.
+pub trait Observer: Debug + Send + Sync {
+    /// Started copying the content of a file.
+    fn file_started(&self, _apath: &Apath) {}
+
+    /// Finished copying a file of `bytes` bytes.
+    ///
+    /// During a backup, small files are collected into combined blocks, which
+    /// may be written a little later.
+    fn file_completed(&self, _apath: &Apath, _bytes: u64) {}
+
+    /// Wrote a new block of `len` uncompressed bytes into the archive.
+    ///
+    /// This isn't called for blocks that were already present.
+    fn block_stored(&self, _hash: &BlockHash, _len: usize) {}
+
+    /// Failed to copy an entry. The operation may carry on with other
+    /// entries.
+    fn error(&self, _apath: &Apath, _error: &Error) {}
+}
@@ -0,0 +1,177 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Choose old backups to delete according to a retention policy.
+//!
+//! The selected bands are deleted with [Archive::delete_bands], which only
+//! removes blocks that are not referenced by any remaining band.
+
+use chrono::{DateTime, Duration, Utc};
+
+use crate::*;
+
+/// Which backups to keep when pruning.
+///
+/// A backup is kept if it matches any of the rules. At least one rule must be
+/// given.
+#[derive(Debug, Default, Clone)]
+pub struct RetentionPolicy {
+    /// Keep this many of the most recent complete backups.
+    pub keep_last: Option<usize>,
+
+    /// Keep complete backups started within this long before now.
+    pub keep_within: Option<Duration>,
+}
+
+impl RetentionPolicy {
+    fn is_empty(&self) -> bool {
+        self.keep_last.is_none() && self.keep_within.is_none()
+    }
+}
+
+/// Return the ids of bands that are not retained by the policy, in order.
+///
+/// Incomplete bands, and bands whose metadata can't be read, are never
+/// selected, since they may be in use by a running backup.
+///
+/// Returns `Err(Error::EmptyRetentionPolicy)` if the policy has no rules, so
+/// that a mistake in the options doesn't go unnoticed.
+pub fn bands_to_prune(archive: &Archive, policy: &RetentionPolicy) -> Result<Vec<BandId>> {
+    if policy.is_empty() {
+        return Err(Error::EmptyRetentionPolicy);
+    }
+    let mut complete = Vec::new();
+    for band_id in archive.list_band_ids()? {
+        match Band::open(archive, &band_id).and_then(|band| band.get_info()) {
+            Ok(info) if info.is_closed => complete.push((band_id, info.start_time)),
+            Ok(_) => (),
+            Err(err) => ui::problem(&format!(
+                "Failed to read band {}, so it will be kept: {}",
+                band_id, err
+            )),
+        }
+    }
+    Ok(select_unretained(&complete, policy, Utc::now()))
+}
+
+/// Choose bands from `complete`, in increasing order, that aren't retained.
+fn select_unretained(
+    complete: &[(BandId, DateTime<Utc>)],
+    policy: &RetentionPolicy,
+    now: DateTime<Utc>,
+) -> Vec<BandId> {
+    let n = complete.len();
+    complete
+        .iter()
+        .enumerate()
+        .filter(|(i, (_, start_time))| {
+            let in_last = policy.keep_last.map_or(false, |keep| n - i <= keep);
+            let within = policy
+                .keep_within
+                .map_or(false, |age| now - *start_time <= age);
+            !(in_last || within)
+        })
+        .map(|(_, (band_id, _))| band_id.clone())
+        .collect()
+}
+
+/// Parse a duration such as `12h`, `30d`, or `8w`.
+pub fn parse_duration(s: &str) -> std::result::Result<Duration, String> {
+    let s = s.trim();
+    let split = s.len() - s.chars().last().map_or(0, char::len_utf8);
+    let (number, unit) = s.split_at(split);
+    let number: i64 = number
+        .parse()
+        .map_err(|_| format!("Invalid duration {:?}: expected a number and unit", s))?;
+    match unit {
+        "h" => Ok(Duration::hours(number)),
+        "d" => Ok(Duration::days(number)),
+        "w" => Ok(Duration::weeks(number)),
+        _ => Err(format!(
+            "Invalid duration {:?}: unit should be h, d, or w",
+            s
+        )),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::TimeZone;
+
+    use super::*;
+
+    fn sample_bands() -> Vec<(BandId, DateTime<Utc>)> {
+        (0..5)
+            .map(|i| (BandId::new(&[i]), Utc.ymd(2022, 1, 1 + i).and_hms(0, 0, 0)))
+            .collect()
+    }
+
+    fn ids(band_ids: &[BandId]) -> Vec<String> {
+        band_ids.iter().map(BandId::to_string).collect()
+    }
+
+    #[test]
+    fn empty_policy_keeps_everything() {
+        let now = Utc.ymd(2022, 2, 1).and_hms(0, 0, 0);
+        assert!(select_unretained(&sample_bands(), &RetentionPolicy::default(), now).is_empty());
+    }
+
+    #[test]
+    fn keep_last() {
+        let now = Utc.ymd(2022, 2, 1).and_hms(0, 0, 0);
+        let policy = RetentionPolicy {
+            keep_last: Some(2),
+            ..RetentionPolicy::default()
+        };
+        assert_eq!(
+            ids(&select_unretained(&sample_bands(), &policy, now)),
+            ["b0000", "b0001", "b0002"]
+        );
+    }
+
+    #[test]
+    fn keep_within() {
+        let now = Utc.ymd(2022, 1, 5).and_hms(12, 0, 0);
+        let policy = RetentionPolicy {
+            keep_within: Some(Duration::days(2)),
+            ..RetentionPolicy::default()
+        };
+        assert_eq!(
+            ids(&select_unretained(&sample_bands(), &policy, now)),
+            ["b0000", "b0001", "b0002"]
+        );
+    }
+
+    #[test]
+    fn keep_if_any_rule_matches() {
+        let now = Utc.ymd(2022, 1, 5).and_hms(12, 0, 0);
+        let policy = RetentionPolicy {
+            keep_last: Some(1),
+            keep_within: Some(Duration::days(3)),
+        };
+        assert_eq!(
+            ids(&select_unretained(&sample_bands(), &policy, now)),
+            ["b0000", "b0001"]
+        );
+    }
+
+    #[test]
+    fn parse_durations() {
+        assert_eq!(parse_duration("12h"), Ok(Duration::hours(12)));
+        assert_eq!(parse_duration("30d"), Ok(Duration::days(30)));
+        assert_eq!(parse_duration("8w"), Ok(Duration::weeks(8)));
+        assert!(parse_duration("8").is_err());
+        assert!(parse_duration("d").is_err());
+        assert!(parse_duration("3y").is_err());
+    }
+}
@@ -12,13 +12,19 @@
 
 //! Restore from the archive to the filesystem.
 
+use std::borrow::Cow;
+use std::cmp::Ordering;
 use std::fs::File;
 use std::io;
-use std::io::Write;
+use std::io::{Seek, SeekFrom, Write};
 use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::Arc;
 use std::{fs, time::Instant};
 
+use blake2_rfc::blake2b::Blake2b;
 use filetime::{set_file_handle_times, set_symlink_file_times};
+use unicode_normalization::UnicodeNormalization;
 
 use crate::band::BandSelectionPolicy;
 use crate::entry::Entry;
@@ -34,9 +40,29 @@ pub struct RestoreOptions {
     pub exclude: Exclude,
     /// Restore only this subdirectory.
     pub only_subtree: Option<Apath>,
+    /// Restore into a destination that's not empty, replacing any existing
+    /// files.
     pub overwrite: bool,
+    /// Restore into a destination that's not empty, leaving any existing
+    /// files and directories untouched. This takes precedence over `overwrite`.
+    pub skip_existing: bool,
+    /// Restore into a destination that's not empty, keeping existing files
+    /// unless they're older than the backup. This takes precedence over
+    /// `skip_existing` and `overwrite`.
+    pub merge: bool,
     // The band to select, or by default the last complete one.
     pub band_selection: BandSelectionPolicy,
+    /// Don't try to restore the owner and group of files.
+    pub no_owner: bool,
+    /// Read back each restored file and check it matches what was written.
+    pub verify: bool,
+    /// Leave holes in restored files where the content is all zeros, rather
+    /// than writing the zeros.
+    pub sparse: bool,
+    /// Convert restored file names to this Unicode normalization form.
+    pub normalize: Normalization,
+    /// Told about files as they're restored.
+    pub observer: Option<Arc<dyn Observer>>,
 }
 
 impl Default for RestoreOptions {
@@ -44,9 +70,56 @@ impl Default for RestoreOptions {
         RestoreOptions {
             print_filenames: false,
             overwrite: false,
+            skip_existing: false,
+            merge: false,
             band_selection: BandSelectionPolicy::LatestClosed,
             exclude: Exclude::nothing(),
             only_subtree: None,
+            no_owner: false,
+            verify: false,
+            sparse: false,
+            normalize: Normalization::None,
+            observer: None,
+        }
+    }
+}
+
+/// A Unicode normalization form for restored file names.
+///
+/// macOS stores names in NFD, decomposing accented letters, while most other
+/// systems keep whatever form they're given, which is usually NFC.
+#[derive(Debug, Clone, Copy, Eq, PartialEq)]
+pub enum Normalization {
+    /// Restore names exactly as they were stored.
+    None,
+    /// Composed form, usual on Linux and Windows.
+    Nfc,
+    /// Decomposed form, used by macOS.
+    Nfd,
+}
+
+impl Normalization {
+    fn apply(self, name: &str) -> Cow<str> {
+        match self {
+            Normalization::None => Cow::Borrowed(name),
+            Normalization::Nfc => Cow::Owned(name.nfc().collect()),
+            Normalization::Nfd => Cow::Owned(name.nfd().collect()),
+        }
+    }
+}
+
+impl FromStr for Normalization {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Normalization, String> {
+        match s.to_ascii_lowercase().as_str() {
+            "none" => Ok(Normalization::None),
+            "nfc" => Ok(Normalization::Nfc),
+            "nfd" => Ok(Normalization::Nfd),
+            _ => Err(format!(
+                "Unknown normalization {:?}: expected nfc, nfd, or none",
+                s
+            )),
         }
     }
 }
@@ -73,11 +146,33 @@ pub fn restore(
     options: &RestoreOptions,
 ) -> Result<RestoreStats> {
     let st = archive.open_stored_tree(options.band_selection.clone())?;
-    let mut rt = if options.overwrite {
+    let mut entry_iter = st
+        .iter_entries(
+            options.only_subtree.clone().unwrap_or_else(Apath::root),
+            options.exclude.clone(),
+        )?
+        .peekable();
+    if let Some(only_subtree) = &options.only_subtree {
+        // Check before creating the destination, so that a typo doesn't leave
+        // behind an empty directory.
+        if entry_iter.peek().is_none() {
+            return Err(Error::SubtreeNotFound {
+                apath: only_subtree.clone(),
+                band_id: st.band().id().clone(),
+            });
+        }
+    }
+    let mut rt = if options.overwrite || options.skip_existing || options.merge {
         RestoreTree::create_overwrite(destination_path)
     } else {
         RestoreTree::create(destination_path)
     }?;
+    rt.restore_owner = !options.no_owner;
+    rt.skip_existing = options.skip_existing;
+    rt.merge = options.merge;
+    rt.verify = options.verify;
+    rt.sparse = options.sparse;
+    rt.normalize = options.normalize;
     let mut stats = RestoreStats::default();
     let progress_bar = nutmeg::View::new(
         ProgressModel {
@@ -86,6 +181,7 @@ pub fn restore(
         },
         ui::nutmeg_options(),
     );
+    let observer = options.observer.as_deref();
     let start = Instant::now();
     // // This causes us to walk the source tree twice, which is probably an acceptable option
     // // since it's nice to see realistic overall progress. We could keep all the entries
@@ -98,10 +194,6 @@ pub fn restore(
     //     // deleted or changed while this is running.
     //     progress_bar.set_bytes_total(st.size(options.excludes.clone())?.file_bytes as u64);
     // }
-    let entry_iter = st.iter_entries(
-        options.only_subtree.clone().unwrap_or_else(Apath::root),
-        options.exclude.clone(),
-    )?;
     for entry in entry_iter {
         if options.print_filenames {
             progress_bar.message(&format!("{}\n", entry.apath()));
@@ -112,9 +204,22 @@ pub fn restore(
                 stats.directories += 1;
                 rt.copy_dir(&entry)
             }
+            Kind::File if entry.unrecoverable => {
+                ui::problem(&format!("Skipping unrecoverable file {}", entry.apath()));
+                stats.unrecoverable_files += 1;
+                Ok(())
+            }
             Kind::File => {
                 stats.files += 1;
-                let result = rt.copy_file(&entry, &st).map(|s| stats += s);
+                if let Some(observer) = observer {
+                    observer.file_started(entry.apath());
+                }
+                let result = rt.copy_file(&entry, &st).map(|s| {
+                    if let Some(observer) = observer {
+                        observer.file_completed(entry.apath(), s.uncompressed_file_bytes);
+                    }
+                    stats += s
+                });
                 if let Some(bytes) = entry.size() {
                     progress_bar.update(|model| model.bytes_done += bytes);
                 }
@@ -122,16 +227,22 @@ pub fn restore(
             }
             Kind::Symlink => {
                 stats.symlinks += 1;
-                rt.copy_symlink(&entry)
+                rt.copy_symlink(&entry).map(|s| stats += s)
+            }
+            Kind::Fifo | Kind::BlockDevice | Kind::CharDevice => {
+                rt.copy_special(&entry).map(|s| stats += s)
             }
             Kind::Unknown => {
                 stats.unknown_kind += 1;
-                // TODO: Perhaps eventually we could backup and restore pipes,
-                // sockets, etc. Or at least count them. For now, silently skip.
+                // TODO: Perhaps eventually we could backup and restore
+                // sockets. Or at least count them. For now, silently skip.
                 // https://github.com/sourcefrog/conserve/issues/82
                 continue;
             }
         } {
+            if let Some(observer) = observer {
+                observer.error(entry.apath(), &e);
+            }
             ui::show_error(&e);
             stats.errors += 1;
             continue;
@@ -143,19 +254,99 @@ pub fn restore(
     Ok(stats)
 }
 
+/// Write the content of the single file selected by `options.only_subtree`,
+/// rather than restoring into a directory.
+///
+/// Returns `Err(Error::RestoreToStdoutNotAFile)` if the selection is a
+/// directory, including if no subtree is given.
+pub fn restore_to_writer(
+    archive: &Archive,
+    w: &mut dyn Write,
+    options: &RestoreOptions,
+) -> Result<RestoreStats> {
+    let start = Instant::now();
+    let st = archive.open_stored_tree(options.band_selection.clone())?;
+    let apath = options.only_subtree.clone().unwrap_or_else(Apath::root);
+    let mut content = match st.open_file(&apath) {
+        Err(Error::NotAFile { apath, kind }) => {
+            return Err(Error::RestoreToStdoutNotAFile { apath, kind })
+        }
+        other => other?,
+    };
+    let bytes_copied = std::io::copy(&mut content, w)?;
+    w.flush()?;
+    Ok(RestoreStats {
+        files: 1,
+        uncompressed_file_bytes: bytes_copied,
+        elapsed: start.elapsed(),
+        ..RestoreStats::default()
+    })
+}
+
 /// A write-only tree on the filesystem, as a restore destination.
 #[derive(Debug)]
 pub struct RestoreTree {
     path: PathBuf,
 
-    dir_mtimes: Vec<(PathBuf, UnixTime)>,
+    /// Metadata to set on directories once their contents are written.
+    dir_metadata: Vec<DirMetadata>,
+
+    /// Try to set the owner and group of restored files.
+    ///
+    /// This is turned off after the first time it's refused, so that an
+    /// unprivileged restore doesn't complain about every file.
+    restore_owner: bool,
+
+    /// Try to make device nodes, which is turned off after the first time
+    /// it's refused.
+    restore_devices: bool,
+
+    /// Leave existing entries in the destination alone.
+    skip_existing: bool,
+
+    /// Keep existing entries in the destination unless they're older than
+    /// the backup.
+    merge: bool,
+
+    /// Read back restored files to check them.
+    verify: bool,
+
+    /// Write runs of zeros as holes.
+    sparse: bool,
+
+    /// Convert file names to this normalization form.
+    normalize: Normalization,
+
+    /// True if the destination was empty when the restore started, so that
+    /// any existing entry must have been restored under another name that
+    /// the filesystem treats as the same.
+    detect_collisions: bool,
+}
+
+/// Metadata for a restored directory, which is applied after its contents are
+/// written, so that restrictive permissions don't get in the way.
+#[derive(Debug)]
+struct DirMetadata {
+    path: PathBuf,
+    mtime: UnixTime,
+    unix_mode: Option<u32>,
+    uid: Option<u32>,
+    gid: Option<u32>,
 }
 
 impl RestoreTree {
     fn new(path: PathBuf) -> RestoreTree {
         RestoreTree {
             path,
-            dir_mtimes: Vec::new(),
+            dir_metadata: Vec::new(),
+            restore_owner: true,
+            restore_devices: true,
+            skip_existing: false,
+            merge: false,
+            verify: false,
+            sparse: false,
+            normalize: Normalization::None,
+            detect_collisions: false,
         }
     }
 
@@ -166,7 +357,10 @@ impl RestoreTree {
         let path = path.into();
         match ensure_dir_exists(&path).and_then(|()| directory_is_empty(&path)) {
             Err(source) => Err(Error::Restore { path, source }),
-            Ok(true) => Ok(RestoreTree::new(path)),
+            Ok(true) => Ok(RestoreTree {
+                detect_collisions: true,
+                ..RestoreTree::new(path)
+            }),
             Ok(false) => Err(Error::DestinationNotEmpty { path }),
         }
     }
@@ -178,12 +372,73 @@ impl RestoreTree {
 
     fn rooted_path(&self, apath: &Apath) -> PathBuf {
         // Remove initial slash so that the apath is relative to the destination.
-        self.path.join(&apath[1..])
+        self.path.join(&*self.normalize.apply(&apath[1..]))
     }
 
-    fn finish(self) -> Result<RestoreStats> {
-        for (path, time) in self.dir_mtimes {
-            if let Err(err) = filetime::set_file_mtime(path, time.into()) {
+    fn name_collision(path: &Path) -> Error {
+        Error::RestoreNameCollision {
+            path: path.to_owned(),
+        }
+    }
+
+    /// Check for an existing file or symlink where an entry is about to be
+    /// restored, which can only happen if the destination wasn't empty, or if
+    /// the filesystem treats the names of two restored entries as the same.
+    ///
+    /// Returns false if the entry should be skipped. If it's to be
+    /// overwritten, the existing file is removed first, so that content isn't
+    /// written through an existing symlink.
+    fn prepare_destination<E: Entry>(
+        &self,
+        path: &Path,
+        entry: &E,
+        stats: &mut RestoreStats,
+    ) -> Result<bool> {
+        match fs::symlink_metadata(path) {
+            Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(true),
+            Err(source) => Err(Error::Restore {
+                path: path.to_owned(),
+                source,
+            }),
+            Ok(_) if self.detect_collisions => Err(RestoreTree::name_collision(path)),
+            Ok(metadata) if self.merge && !metadata.is_dir() && keep_in_merge(&metadata, entry) => {
+                stats.kept_newer += 1;
+                Ok(false)
+            }
+            // In a merge, older files are replaced even if `skip_existing` is
+            // also set.
+            Ok(_) if self.skip_existing && !self.merge => {
+                stats.skipped_existing += 1;
+                Ok(false)
+            }
+            Ok(metadata) if metadata.is_dir() => Err(Error::Restore {
+                path: path.to_owned(),
+                source: io::Error::new(
+                    io::ErrorKind::AlreadyExists,
+                    "a directory already exists here",
+                ),
+            }),
+            Ok(_) => {
+                stats.overwritten += 1;
+                fs::remove_file(path).map_err(|source| Error::Restore {
+                    path: path.to_owned(),
+                    source,
+                })?;
+                Ok(true)
+            }
+        }
+    }
+
+    fn finish(mut self) -> Result<RestoreStats> {
+        // Visit children before their parents, so that a parent being made
+        // unwritable or unsearchable can't prevent updating its children.
+        let dir_metadata = std::mem::take(&mut self.dir_metadata);
+        for dir in dir_metadata.into_iter().rev() {
+            self.set_owner(&dir.path, dir.uid, dir.gid);
+            if let Err(err) = set_unix_mode(&dir.path, dir.unix_mode) {
+                ui::problem(&format!("Failed to set directory permissions: {:?}", err));
+            }
+            if let Err(err) = filetime::set_file_mtime(&dir.path, dir.mtime.into()) {
                 ui::problem(&format!("Failed to set directory mtime: {:?}", err));
             }
         }
@@ -192,12 +447,28 @@ impl RestoreTree {
 
     fn copy_dir<E: Entry>(&mut self, entry: &E) -> Result<()> {
         let path = self.rooted_path(entry.apath());
+        // The root already exists, because the restore tree was created there.
+        if self.detect_collisions
+            && *entry.apath() != Apath::root()
+            && fs::symlink_metadata(&path).is_ok()
+        {
+            return Err(RestoreTree::name_collision(&path));
+        }
+        if (self.skip_existing || self.merge) && path.is_dir() {
+            return Ok(());
+        }
         if let Err(source) = fs::create_dir_all(&path) {
             if source.kind() != io::ErrorKind::AlreadyExists {
                 return Err(Error::Restore { path, source });
             }
         }
-        self.dir_mtimes.push((path, entry.mtime()));
+        self.dir_metadata.push(DirMetadata {
+            path,
+            mtime: entry.mtime(),
+            unix_mode: entry.unix_mode(),
+            uid: entry.uid(),
+            gid: entry.gid(),
+        });
         Ok(())
     }
 
@@ -207,17 +478,25 @@ impl RestoreTree {
         source_entry: &R::Entry,
         from_tree: &R,
     ) -> Result<RestoreStats> {
-        // TODO: Restore permissions.
         let path = self.rooted_path(source_entry.apath());
         let restore_err = |source| Error::Restore {
             path: path.clone(),
             source,
         };
+        let mut stats = RestoreStats::default();
+        if !self.prepare_destination(&path, source_entry, &mut stats)? {
+            return Ok(stats);
+        }
         let mut restore_file = File::create(&path).map_err(restore_err)?;
         // TODO: Read one block at a time: don't pull all the contents into memory.
         let content = &mut from_tree.file_contents(source_entry)?;
-        let bytes_copied = std::io::copy(content, &mut restore_file).map_err(restore_err)?;
-        restore_file.flush().map_err(restore_err)?;
+        let mut writer = HashingWriter::new(
+            SparseFileWriter::new(&mut restore_file, self.sparse),
+            self.verify,
+        );
+        let bytes_copied = std::io::copy(content, &mut writer).map_err(restore_err)?;
+        writer.flush().map_err(restore_err)?;
+        let written_hash = writer.finish();
 
         let mtime = Some(source_entry.mtime().into());
         set_file_handle_times(&restore_file, mtime, mtime).map_err(|source| {
@@ -226,19 +505,44 @@ impl RestoreTree {
                 source,
             }
         })?;
+        drop(restore_file);
+
+        if let Some(written_hash) = written_hash {
+            // Check before setting the mode, which might make it unreadable.
+            let mut reader = HashingWriter::new(io::sink(), true);
+            std::io::copy(&mut File::open(&path).map_err(restore_err)?, &mut reader)
+                .map_err(restore_err)?;
+            if reader.finish() == Some(written_hash) {
+                stats.verified_files += 1;
+            } else {
+                ui::problem(&format!(
+                    "Restored file {:?} doesn't match the content that was written",
+                    path
+                ));
+                stats.verify_failures += 1;
+            }
+        }
+
+        // Set the owner first, because changing it can clear the setuid bits.
+        self.set_owner(&path, source_entry.uid(), source_entry.gid());
+        set_unix_mode(&path, source_entry.unix_mode())?;
 
         // TODO: Accumulate more stats.
         Ok(RestoreStats {
             uncompressed_file_bytes: bytes_copied,
-            ..RestoreStats::default()
+            ..stats
         })
     }
 
     #[cfg(unix)]
-    fn copy_symlink<E: Entry>(&mut self, entry: &E) -> Result<()> {
+    fn copy_symlink<E: Entry>(&mut self, entry: &E) -> Result<RestoreStats> {
         use std::os::unix::fs as unix_fs;
+        let mut stats = RestoreStats::default();
         if let Some(ref target) = entry.symlink_target() {
             let path = self.rooted_path(entry.apath());
+            if !self.prepare_destination(&path, entry, &mut stats)? {
+                return Ok(stats);
+            }
             if let Err(source) = unix_fs::symlink(target, &path) {
                 return Err(Error::Restore { path, source });
             }
@@ -246,21 +550,265 @@ impl RestoreTree {
             if let Err(source) = set_symlink_file_times(&path, mtime, mtime) {
                 return Err(Error::RestoreModificationTime { path, source });
             }
+            self.set_owner(&path, entry.uid(), entry.gid());
         } else {
             // TODO: Treat as an error.
             ui::problem(&format!("No target in symlink entry {}", entry.apath()));
         }
-        Ok(())
+        Ok(stats)
     }
 
     #[cfg(not(unix))]
-    fn copy_symlink<E: Entry>(&mut self, entry: &E) -> Result<()> {
+    fn copy_symlink<E: Entry>(&mut self, entry: &E) -> Result<RestoreStats> {
         // TODO: Add a test with a canned index containing a symlink, and expect
         // it cannot be restored on Windows and can be on Unix.
         ui::problem(&format!(
             "Can't restore symlinks on non-Unix: {}",
             entry.apath()
         ));
+        Ok(RestoreStats::default())
+    }
+
+    /// Recreate a named pipe or device node.
+    ///
+    /// Making device nodes needs privileges. If that's refused, there's one
+    /// warning, and then all device nodes are skipped.
+    #[cfg(unix)]
+    fn copy_special<E: Entry>(&mut self, entry: &E) -> Result<RestoreStats> {
+        let mut stats = RestoreStats::default();
+        let is_device = entry.kind().is_device();
+        if is_device && !self.restore_devices {
+            stats.skipped_device_nodes += 1;
+            return Ok(stats);
+        }
+        let path = self.rooted_path(entry.apath());
+        if !self.prepare_destination(&path, entry, &mut stats)? {
+            return Ok(stats);
+        }
+        let mode = entry.unix_mode().unwrap_or(0o644);
+        match make_special_file(&path, entry.kind(), mode, entry.device()) {
+            Ok(()) => stats.special_files += 1,
+            Err(err) if is_device && err.kind() == io::ErrorKind::PermissionDenied => {
+                ui::problem(&format!(
+                    "Not permitted to create device nodes; skipping them: {}",
+                    err
+                ));
+                self.restore_devices = false;
+                stats.skipped_device_nodes += 1;
+                return Ok(stats);
+            }
+            Err(source) => return Err(Error::Restore { path, source }),
+        }
+        // Don't open the file to set its times, because opening a pipe would
+        // block.
+        let mtime = entry.mtime().into();
+        if let Err(source) = set_symlink_file_times(&path, mtime, mtime) {
+            return Err(Error::RestoreModificationTime { path, source });
+        }
+        self.set_owner(&path, entry.uid(), entry.gid());
+        set_unix_mode(&path, entry.unix_mode())?;
+        Ok(stats)
+    }
+
+    #[cfg(not(unix))]
+    fn copy_special<E: Entry>(&mut self, entry: &E) -> Result<RestoreStats> {
+        ui::problem(&format!(
+            "Can't restore pipes or device nodes on non-Unix: {}",
+            entry.apath()
+        ));
+        Ok(RestoreStats {
+            unknown_kind: 1,
+            ..RestoreStats::default()
+        })
+    }
+
+    /// Set the owner and group of a restored file, directory, or symlink, if
+    /// they're known and we're allowed to.
+    ///
+    /// Failures don't stop the restore.
+    #[cfg(unix)]
+    fn set_owner(&mut self, path: &Path, uid: Option<u32>, gid: Option<u32>) {
+        if !self.restore_owner || (uid.is_none() && gid.is_none()) {
+            return;
+        }
+        if let Err(err) = std::os::unix::fs::lchown(path, uid, gid) {
+            if err.kind() == io::ErrorKind::PermissionDenied {
+                ui::problem(&format!(
+                    "Not permitted to restore file ownership; continuing without it: {}",
+                    err
+                ));
+                self.restore_owner = false;
+            } else {
+                ui::problem(&format!(
+                    "Failed to restore ownership of {:?}: {}",
+                    path, err
+                ));
+            }
+        }
+    }
+
+    #[cfg(not(unix))]
+    fn set_owner(&mut self, _path: &Path, _uid: Option<u32>, _gid: Option<u32>) {}
+}
+
+/// Pass writes through to another writer, optionally hashing everything
+/// written.
+struct HashingWriter<W: Write> {
+    inner: W,
+    hasher: Option<Blake2b>,
+}
+
+impl<W: Write> HashingWriter<W> {
+    fn new(inner: W, hash: bool) -> HashingWriter<W> {
+        HashingWriter {
+            inner,
+            hasher: hash.then(|| Blake2b::new(BLAKE_HASH_SIZE_BYTES)),
+        }
+    }
+
+    /// Return the hash of everything written, if hashing was enabled.
+    fn finish(self) -> Option<BlockHash> {
+        self.hasher.map(|hasher| BlockHash::from(hasher.finalize()))
+    }
+}
+
+impl<W: Write> Write for HashingWriter<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let len = self.inner.write(buf)?;
+        if let Some(hasher) = &mut self.hasher {
+            hasher.update(&buf[..len]);
+        }
+        Ok(len)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.inner.flush()
+    }
+}
+
+/// Write to a file, optionally seeking over runs of zeros rather than writing
+/// them, so that the filesystem can leave holes.
+///
+/// Zeros are detected in whatever size of buffer is passed to `write`, so
+/// only runs spanning a whole buffer become holes.
+struct SparseFileWriter<'a> {
+    file: &'a mut File,
+    sparse: bool,
+    /// Length of the file so far, including any trailing hole.
+    len: u64,
+    /// True if the last bytes were skipped, so the file needs to be extended
+    /// to its full length.
+    trailing_hole: bool,
+}
+
+impl<'a> SparseFileWriter<'a> {
+    fn new(file: &'a mut File, sparse: bool) -> SparseFileWriter<'a> {
+        SparseFileWriter {
+            file,
+            sparse,
+            len: 0,
+            trailing_hole: false,
+        }
+    }
+}
+
+impl<'a> Write for SparseFileWriter<'a> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let len = if self.sparse && !buf.is_empty() && buf.iter().all(|&b| b == 0) {
+            self.file.seek(SeekFrom::Current(buf.len() as i64))?;
+            self.trailing_hole = true;
+            buf.len()
+        } else {
+            self.trailing_hole = false;
+            self.file.write(buf)?
+        };
+        self.len += len as u64;
+        Ok(len)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        if self.trailing_hole {
+            self.file.set_len(self.len)?;
+        }
+        self.file.flush()
+    }
+}
+
+/// True if an existing file or symlink should be kept in a merge: if it's
+/// newer than the entry in the backup, or has the same mtime and size.
+fn keep_in_merge<E: Entry>(metadata: &fs::Metadata, entry: &E) -> bool {
+    let existing_mtime = match metadata.modified() {
+        Ok(mtime) => UnixTime::from(mtime),
+        // Without a time to compare, don't risk replacing newer data.
+        Err(_) => return true,
+    };
+    let backup_mtime = entry.mtime();
+    match (existing_mtime.secs, existing_mtime.nanosecs)
+        .cmp(&(backup_mtime.secs, backup_mtime.nanosecs))
+    {
+        Ordering::Greater => true,
+        Ordering::Equal => entry.kind() != Kind::File || entry.size() == Some(metadata.len()),
+        Ordering::Less => false,
+    }
+}
+
+/// Set Unix permission bits on a restored file or directory, if they're known.
+#[cfg(unix)]
+fn set_unix_mode(path: &Path, unix_mode: Option<u32>) -> Result<()> {
+    use std::os::unix::fs::PermissionsExt;
+    if let Some(mode) = unix_mode {
+        fs::set_permissions(path, fs::Permissions::from_mode(mode)).map_err(|source| {
+            Error::RestorePermissions {
+                path: path.to_owned(),
+                source,
+            }
+        })?;
+    }
+    Ok(())
+}
+
+#[cfg(not(unix))]
+fn set_unix_mode(_path: &Path, _unix_mode: Option<u32>) -> Result<()> {
+    Ok(())
+}
+
+/// Make a named pipe or device node with the given permissions.
+#[cfg(unix)]
+fn make_special_file(
+    path: &Path,
+    kind: Kind,
+    mode: u32,
+    device: Option<DeviceNumber>,
+) -> io::Result<()> {
+    use std::ffi::CString;
+    use std::os::unix::ffi::OsStrExt;
+
+    let c_path = CString::new(path.as_os_str().as_bytes())
+        .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "path contains a nul byte"))?;
+    let mode = (mode & 0o7777) as libc::mode_t;
+    let result = match kind {
+        // Safety: the path is a valid nul-terminated string.
+        Kind::Fifo => unsafe { libc::mkfifo(c_path.as_ptr(), mode) },
+        Kind::BlockDevice | Kind::CharDevice => {
+            let device = device.ok_or_else(|| {
+                io::Error::new(
+                    io::ErrorKind::InvalidData,
+                    "device node has no device number",
+                )
+            })?;
+            let file_type = if kind == Kind::BlockDevice {
+                libc::S_IFBLK
+            } else {
+                libc::S_IFCHR
+            };
+            // Safety: the path is a valid nul-terminated string.
+            unsafe { libc::mknod(c_path.as_ptr(), file_type | mode, device.rdev()) }
+        }
+        _ => panic!("{:?} is not a special file kind", kind),
+    };
+    if result == 0 {
         Ok(())
+    } else {
+        Err(io::Error::last_os_error())
     }
 }
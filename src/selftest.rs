@@ -0,0 +1,161 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Check that backup and restore work end to end on this platform.
+//!
+//! This makes a small source tree in a temporary directory, backs it up into
+//! a new archive, validates the archive, restores it, and compares the
+//! restored tree to the source.
+
+use std::fs;
+use std::path::Path;
+
+use crate::*;
+
+/// Run the self-test.
+///
+/// The temporary directory is deleted if the test passes. If anything goes
+/// wrong, it's left in place for debugging, and its path is included in the
+/// error.
+pub fn selftest() -> Result<()> {
+    let tempdir = tempfile::Builder::new()
+        .prefix("conserve-selftest-")
+        .tempdir()?;
+    match run_selftest(tempdir.path()) {
+        Ok(()) => Ok(()),
+        Err(err) => {
+            let path = tempdir.into_path();
+            Err(Error::SelfTestFailed {
+                message: ui::format_error_causes(&err),
+                path,
+            })
+        }
+    }
+}
+
+fn run_selftest(dir: &Path) -> Result<()> {
+    let source_path = dir.join("source");
+    let archive_path = dir.join("archive");
+    let restore_path = dir.join("restore");
+    make_source_tree(&source_path)?;
+
+    ui::println("Back up...");
+    let archive = Archive::create_path(&archive_path)?;
+    let backup_stats = backup(
+        &archive,
+        &LiveTree::open(&source_path)?,
+        &BackupOptions::default(),
+    )?;
+    check(backup_stats.errors == 0, "backup had errors")?;
+
+    ui::println("Validate...");
+    let validate_stats = archive.validate(&ValidateOptions::default())?;
+    check(!validate_stats.has_problems(), "archive has problems")?;
+
+    ui::println("Restore...");
+    let restore_stats = restore(&archive, &restore_path, &RestoreOptions::default())?;
+    check(restore_stats.errors == 0, "restore had errors")?;
+
+    ui::println("Compare...");
+    compare_trees(&source_path, &restore_path)?;
+    ui::println("Self-test passed.");
+    Ok(())
+}
+
+/// Make a source tree with some variety of contents.
+fn make_source_tree(path: &Path) -> Result<()> {
+    fs::create_dir(path)?;
+    fs::write(path.join("hello"), b"hello world\n")?;
+    fs::write(path.join("empty"), b"")?;
+    fs::create_dir_all(path.join("subdir/nested"))?;
+    fs::write(path.join("subdir/nested/small"), b"small file\n")?;
+    for i in 0..100 {
+        fs::write(
+            path.join("subdir").join(format!("file{:03}", i)),
+            format!("content of file {}\n", i).repeat(i + 1),
+        )?;
+    }
+    // Big enough to be split across several blocks.
+    let mut state: u32 = 1;
+    let large: Vec<u8> = (0..(3 * MAX_BLOCK_SIZE + 12345))
+        .map(|_| {
+            state = state.wrapping_mul(1_103_515_245).wrapping_add(12345);
+            (state >> 16) as u8
+        })
+        .collect();
+    fs::write(path.join("large"), large)?;
+    #[cfg(unix)]
+    std::os::unix::fs::symlink("subdir/nested/small", path.join("link"))?;
+    Ok(())
+}
+
+/// Check that two trees have the same entries, file contents, and symlink
+/// targets.
+fn compare_trees(source: &Path, restored: &Path) -> Result<()> {
+    let source_entries = list_entries(source)?;
+    let restored_entries = list_entries(restored)?;
+    check(
+        source_entries.len() == restored_entries.len(),
+        "restored tree has a different number of entries",
+    )?;
+    for (a, b) in source_entries.iter().zip(restored_entries.iter()) {
+        let apath = a.apath();
+        check(
+            apath == b.apath(),
+            &format!("expected {} but found {}", apath, b.apath()),
+        )?;
+        check(
+            a.kind() == b.kind(),
+            &format!("{} has the wrong kind", apath),
+        )?;
+        check(
+            a.symlink_target() == b.symlink_target(),
+            &format!("{} has the wrong symlink target", apath),
+        )?;
+        if a.kind() == Kind::File {
+            check(
+                fs::read(apath.below(source))? == fs::read(apath.below(restored))?,
+                &format!("{} has different content", apath),
+            )?;
+            check(
+                a.mtime() == b.mtime(),
+                &format!("{} has a different mtime", apath),
+            )?;
+        }
+    }
+    Ok(())
+}
+
+fn list_entries(path: &Path) -> Result<Vec<LiveEntry>> {
+    Ok(LiveTree::open(path)?
+        .iter_entries(Apath::root(), Exclude::nothing())?
+        .collect())
+}
+
+fn check(ok: bool, problem: &str) -> Result<()> {
+    if ok {
+        Ok(())
+    } else {
+        Err(Error::SelfTestProblem {
+            problem: problem.to_owned(),
+        })
+    }
+}
+
+#[cfg(test)]
+mod test {
+    #[test]
+    fn selftest_passes() {
+        super::selftest().unwrap();
+    }
+}
@@ -17,8 +17,11 @@
 //! file (typically stdout).
 
 use std::borrow::Cow;
+use std::collections::{HashMap, HashSet};
 use std::io::{BufWriter, Write};
 
+use serde::Serialize;
+
 use crate::*;
 
 /// Options controlling the behavior of `show_versions`.
@@ -35,6 +38,9 @@ pub struct ShowVersionsOptions {
     pub backup_duration: bool,
     /// Show times in UTC rather than the local timezone.
     pub utc: bool,
+    /// Show the host and source directory each backup was made from, and the
+    /// version of Conserve that made it.
+    pub origin: bool,
 }
 
 /// Print a list of versions, one per line.
@@ -48,7 +54,7 @@ pub fn show_versions(
         band_ids.reverse();
     }
     for band_id in band_ids {
-        if !(options.tree_size || options.start_time || options.backup_duration) {
+        if !(options.tree_size || options.start_time || options.backup_duration || options.origin) {
             writeln!(w, "{}", band_id)?;
             continue;
         }
@@ -104,11 +110,160 @@ pub fn show_versions(
             l.push(format!("{:>14}", tree_mb_str,));
         }
 
+        if options.origin {
+            l.push(format!("{:<20}", info.hostname.as_deref().unwrap_or("-")));
+            l.push(format!(
+                "{:<12}",
+                info.conserve_version.as_deref().unwrap_or("-")
+            ));
+            l.push(info.source.unwrap_or_else(|| "-".to_owned()));
+        }
+
+        if let Some(label) = info.label {
+            l.push(label);
+        }
+
         writeln!(w, "{}", l.join(" "))?;
     }
     Ok(())
 }
 
+/// One version in the output of `show_versions_json`.
+#[derive(Debug, Serialize)]
+struct VersionJson {
+    id: String,
+    label: Option<String>,
+    is_complete: bool,
+    start_time: chrono::DateTime<chrono::Utc>,
+    end_time: Option<chrono::DateTime<chrono::Utc>>,
+    hostname: Option<String>,
+    source: Option<String>,
+    conserve_version: Option<String>,
+    /// Number of distinct blocks referenced by this version's index.
+    blocks: usize,
+    /// Blocks not referenced by any older version.
+    new_blocks: usize,
+    /// Blocks referenced by no other version, which would be freed if only
+    /// this version were deleted.
+    unique_blocks: usize,
+    /// Referenced blocks that aren't present in the archive.
+    missing_blocks: usize,
+}
+
+/// Print a JSON list of versions, including how many blocks each one shares
+/// with the others.
+///
+/// Every version's index is complete in itself, and versions depend on each
+/// other only by referring to the same blocks. This reads every index, and
+/// lists the block directory, but doesn't read the blocks themselves.
+pub fn show_versions_json(
+    archive: &Archive,
+    options: &ShowVersionsOptions,
+    w: &mut dyn Write,
+) -> Result<()> {
+    let band_ids = archive.list_band_ids()?;
+    let present: HashSet<BlockHash> = archive.block_dir().block_names()?.collect();
+    let mut band_blocks: Vec<HashSet<BlockHash>> = Vec::with_capacity(band_ids.len());
+    for band_id in &band_ids {
+        band_blocks.push(archive.referenced_blocks(std::slice::from_ref(band_id))?);
+    }
+    let mut reference_counts: HashMap<&BlockHash, usize> = HashMap::new();
+    for hash in band_blocks.iter().flatten() {
+        *reference_counts.entry(hash).or_default() += 1;
+    }
+    let mut seen: HashSet<&BlockHash> = HashSet::new();
+    let mut versions = Vec::with_capacity(band_ids.len());
+    for (band_id, blocks) in band_ids.iter().zip(&band_blocks) {
+        let info = Band::open(archive, band_id)?.get_info()?;
+        versions.push(VersionJson {
+            id: band_id.to_string(),
+            label: info.label,
+            is_complete: info.is_closed,
+            start_time: info.start_time,
+            end_time: info.end_time,
+            hostname: info.hostname,
+            source: info.source,
+            conserve_version: info.conserve_version,
+            blocks: blocks.len(),
+            new_blocks: blocks.iter().filter(|hash| !seen.contains(hash)).count(),
+            unique_blocks: blocks
+                .iter()
+                .filter(|hash| reference_counts[hash] == 1)
+                .count(),
+            missing_blocks: blocks
+                .iter()
+                .filter(|hash| !present.contains(*hash))
+                .count(),
+        });
+        seen.extend(blocks);
+    }
+    if options.newest_first {
+        versions.reverse();
+    }
+    let mut bw = BufWriter::new(w);
+    serde_json::ser::to_writer_pretty(&mut bw, &versions).map_err(|source| {
+        Error::SerializeJson {
+            path: "versions".to_owned(),
+            source,
+        }
+    })?;
+    writeln!(bw)?;
+    Ok(())
+}
+
+/// Print everything that's recorded about one band, one field per line.
+pub fn show_band_info(band: &Band, utc: bool, w: &mut dyn Write) -> Result<()> {
+    let info = band.get_info()?;
+    let format_time = |time: chrono::DateTime<chrono::Utc>| {
+        if utc {
+            time.format(crate::TIMESTAMP_FORMAT).to_string()
+        } else {
+            time.with_timezone(&chrono::Local)
+                .format(crate::TIMESTAMP_FORMAT)
+                .to_string()
+        }
+    };
+    let unknown = || "unknown".to_owned();
+    writeln!(w, "{:<18} {}", "version:", info.id)?;
+    if let Some(label) = &info.label {
+        writeln!(w, "{:<18} {}", "label:", label)?;
+    }
+    writeln!(w, "{:<18} {}", "start time:", format_time(info.start_time))?;
+    match info.end_time {
+        Some(end_time) => {
+            writeln!(w, "{:<18} {}", "end time:", format_time(end_time))?;
+            let duration = (end_time - info.start_time)
+                .to_std()
+                .map(|duration| crate::ui::duration_to_hms(duration).trim().to_owned())
+                .unwrap_or_else(|_| unknown());
+            writeln!(w, "{:<18} {}", "duration:", duration)?;
+        }
+        None => writeln!(w, "{:<18} incomplete", "end time:")?,
+    }
+    writeln!(
+        w,
+        "{:<18} {}",
+        "hostname:",
+        info.hostname.unwrap_or_else(unknown)
+    )?;
+    writeln!(
+        w,
+        "{:<18} {}",
+        "source:",
+        info.source.unwrap_or_else(unknown)
+    )?;
+    writeln!(
+        w,
+        "{:<18} {}",
+        "conserve version:",
+        info.conserve_version.unwrap_or_else(unknown)
+    )?;
+    if let Some(index_hunk_count) = info.index_hunk_count {
+        writeln!(w, "{:<18} {}", "index hunks:", index_hunk_count)?;
+    }
+    Ok(())
+}
+
 pub fn show_index_json(band: &Band, w: &mut dyn Write) -> Result<()> {
     // TODO: Maybe use https://docs.serde.rs/serde/ser/trait.Serializer.html#method.collect_seq.
     let bw = BufWriter::new(w);
@@ -125,6 +280,47 @@ pub fn show_entry_names<E: Entry, I: Iterator<Item = E>>(it: I, w: &mut dyn Writ
     Ok(())
 }
 
+/// Print entries one per line with their kind, size, and modification time,
+/// similar to `ls -l`.
+pub fn show_entry_details<E: Entry, I: Iterator<Item = E>>(
+    it: I,
+    utc: bool,
+    w: &mut dyn Write,
+) -> Result<()> {
+    use chrono::TimeZone;
+
+    let mut bw = BufWriter::new(w);
+    for entry in it {
+        let kind = match entry.kind() {
+            Kind::Dir => 'd',
+            Kind::File => '-',
+            Kind::Symlink => 'l',
+            Kind::Fifo => 'p',
+            Kind::BlockDevice => 'b',
+            Kind::CharDevice => 'c',
+            Kind::Unknown => '?',
+        };
+        let size = match (entry.kind(), entry.size()) {
+            (Kind::File, Some(size)) => size.to_string(),
+            _ => String::new(),
+        };
+        let mtime = chrono::Utc.timestamp(entry.mtime().secs, 0);
+        let mtime_str = if utc {
+            mtime.format(crate::TIMESTAMP_FORMAT)
+        } else {
+            mtime
+                .with_timezone(&chrono::Local)
+                .format(crate::TIMESTAMP_FORMAT)
+        };
+        write!(bw, "{} {:>12} {} {}", kind, size, mtime_str, entry.apath())?;
+        if let Some(target) = entry.symlink_target() {
+            write!(bw, " -> {}", target)?;
+        }
+        writeln!(bw)?;
+    }
+    Ok(())
+}
+
 pub fn show_diff<D: Iterator<Item = DiffEntry>>(diff: D, w: &mut dyn Write) -> Result<()> {
     // TODO: Consider whether the actual files have changed.
     // TODO: Summarize diff.
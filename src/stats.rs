@@ -15,6 +15,7 @@ use std::fmt;
 use std::time::Duration;
 
 use derive_more::{Add, AddAssign, Sum};
+use serde::Serialize;
 use thousands::Separable;
 
 use crate::ui::duration_to_hms;
@@ -24,7 +25,7 @@ pub fn mb_string(s: u64) -> String {
 }
 
 /// Describe the compression ratio: higher is better.
-fn ratio(uncompressed: u64, compressed: u64) -> f64 {
+pub(crate) fn ratio(uncompressed: u64, compressed: u64) -> f64 {
     if compressed > 0 {
         uncompressed as f64 / compressed as f64
     } else {
@@ -67,7 +68,63 @@ pub struct Sizes {
     pub uncompressed: u64,
 }
 
-#[derive(Debug, Default, Clone, PartialEq, Eq, Add, AddAssign, Sum)]
+/// Summary of the contents of a whole archive, from `Archive::stats`.
+#[derive(Debug, Default, Clone, PartialEq, Serialize)]
+pub struct ArchiveStats {
+    pub versions: usize,
+    /// Start time of the oldest version.
+    pub oldest_version_time: Option<chrono::DateTime<chrono::Utc>>,
+    /// Start time of the newest version.
+    pub newest_version_time: Option<chrono::DateTime<chrono::Utc>>,
+
+    /// Total size of the files in every version, counting files once for each
+    /// version that contains them.
+    pub logical_bytes: u64,
+    /// Uncompressed size of the distinct blocks referenced by any version.
+    pub unique_bytes: u64,
+    /// Total compressed size of the block files.
+    pub stored_bytes: u64,
+    /// Number of block files.
+    pub blocks: usize,
+
+    /// Logical size divided by the size of the distinct referenced data.
+    pub dedup_ratio: f64,
+    /// Uncompressed size of the distinct referenced data divided by the size
+    /// stored.
+    pub compression_ratio: f64,
+}
+
+impl fmt::Display for ArchiveStats {
+    fn fmt(&self, w: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write_count(w, "versions", self.versions);
+        if let (Some(oldest), Some(newest)) = (self.oldest_version_time, self.newest_version_time) {
+            let local = |t: chrono::DateTime<chrono::Utc>| {
+                t.with_timezone(&chrono::Local)
+                    .format(crate::TIMESTAMP_FORMAT)
+                    .to_string()
+            };
+            writeln!(w, "{:>24}   oldest version", local(oldest))?;
+            writeln!(w, "{:>24}   newest version", local(newest))?;
+        }
+        writeln!(w).unwrap();
+
+        write_size(w, "logical size of all versions", self.logical_bytes);
+        write_size(
+            w,
+            &format!("after {:.1}x deduplication", self.dedup_ratio),
+            self.unique_bytes,
+        );
+        write_size(
+            w,
+            &format!("stored after {:.1}x compression", self.compression_ratio),
+            self.stored_bytes,
+        );
+        write_count(w, "blocks", self.blocks);
+        Ok(())
+    }
+}
+
+#[derive(Debug, Default, Clone, PartialEq, Eq, Add, AddAssign, Sum, Serialize)]
 pub struct ValidateStats {
     /// Count of files in the wrong place.
     pub structure_problems: usize,
@@ -138,18 +195,69 @@ pub struct IndexReadStats {
     pub errors: usize,
 }
 
-#[derive(Add, AddAssign, Clone, Debug, Default, Eq, PartialEq)]
+#[derive(Add, AddAssign, Clone, Debug, Default, Eq, PartialEq, Serialize)]
 pub struct IndexWriterStats {
     pub index_hunks: usize,
     pub uncompressed_index_bytes: u64,
     pub compressed_index_bytes: u64,
 }
 
+/// Counts from checking a source tree with `check_source`.
+#[derive(Debug, Default, Clone, Eq, PartialEq)]
+pub struct CheckSourceStats {
+    pub files: usize,
+    pub file_bytes: u64,
+    pub directories: usize,
+    pub symlinks: usize,
+    /// Named pipes and device nodes.
+    pub special_files: usize,
+    pub unknown_kind: usize,
+    pub exclusions: usize,
+
+    /// Files that couldn't be opened for reading.
+    pub unreadable_files: usize,
+    /// Directories whose contents couldn't be listed.
+    pub unreadable_directories: usize,
+    /// Entries whose metadata couldn't be read.
+    pub metadata_errors: usize,
+}
+
+impl CheckSourceStats {
+    /// True if anything in the tree can't be backed up.
+    pub fn has_problems(&self) -> bool {
+        self.unreadable_files > 0 || self.unreadable_directories > 0 || self.metadata_errors > 0
+    }
+}
+
+impl fmt::Display for CheckSourceStats {
+    fn fmt(&self, w: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write_count(w, "files:", self.files);
+        write_size(w, "  ", self.file_bytes);
+        write_count(w, "directories", self.directories);
+        write_count(w, "symlinks", self.symlinks);
+        write_count(w, "fifos and device nodes", self.special_files);
+        write_count(w, "unsupported file kind", self.unknown_kind);
+        write_count(w, "excluded entries", self.exclusions);
+        writeln!(w).unwrap();
+
+        write_count(w, "unreadable files", self.unreadable_files);
+        write_count(w, "unreadable directories", self.unreadable_directories);
+        write_count(w, "metadata errors", self.metadata_errors);
+        Ok(())
+    }
+}
+
 #[derive(Debug, Default, Clone, Eq, PartialEq)]
 pub struct LiveTreeIterStats {
     pub directories_visited: usize,
     pub exclusions: usize,
+    /// Directories not descended into because they're on another filesystem.
+    pub other_filesystems: usize,
+    /// Directories skipped because they contain a `CACHEDIR.TAG`.
+    pub cache_dirs: usize,
     pub metadata_error: usize,
+    /// Directories whose contents couldn't be listed.
+    pub unreadable_directories: usize,
     pub entries_returned: usize,
 }
 
@@ -158,7 +266,27 @@ pub struct RestoreStats {
     pub files: usize,
     pub symlinks: usize,
     pub directories: usize,
+    /// Named pipes and device nodes.
+    pub special_files: usize,
     pub unknown_kind: usize,
+    /// Device nodes that weren't restored because that needs privileges.
+    pub skipped_device_nodes: usize,
+
+    /// Existing files or symlinks in the destination that were replaced.
+    pub overwritten: usize,
+    /// Existing files or symlinks in the destination that were left alone.
+    pub skipped_existing: usize,
+    /// Existing files or symlinks that were kept by a merge, because they're
+    /// at least as new as the backup.
+    pub kept_newer: usize,
+
+    /// Restored files that were read back and matched.
+    pub verified_files: usize,
+    /// Restored files that didn't match when they were read back.
+    pub verify_failures: usize,
+
+    /// Files that were skipped because they're marked unrecoverable.
+    pub unrecoverable_files: usize,
 
     pub errors: usize,
 
@@ -174,9 +302,21 @@ impl fmt::Display for RestoreStats {
 
         write_count(w, "symlinks", self.symlinks);
         write_count(w, "directories", self.directories);
+        write_count(w, "fifos and device nodes", self.special_files);
         write_count(w, "unsupported file kind", self.unknown_kind);
+        write_count(w, "device nodes skipped", self.skipped_device_nodes);
         writeln!(w).unwrap();
 
+        write_count(w, "existing entries overwritten", self.overwritten);
+        write_count(w, "existing entries skipped", self.skipped_existing);
+        write_count(w, "existing newer entries kept", self.kept_newer);
+        writeln!(w).unwrap();
+
+        write_count(w, "files verified", self.verified_files);
+        write_count(w, "verification failures", self.verify_failures);
+        writeln!(w).unwrap();
+
+        write_count(w, "unrecoverable files skipped", self.unrecoverable_files);
         write_count(w, "errors", self.errors);
         write_duration(w, "elapsed", self.elapsed)?;
 
@@ -184,7 +324,7 @@ impl fmt::Display for RestoreStats {
     }
 }
 
-#[derive(Add, AddAssign, Debug, Default, Eq, PartialEq, Clone)]
+#[derive(Add, AddAssign, Debug, Default, Eq, PartialEq, Clone, Serialize)]
 pub struct BackupStats {
     // TODO: Have separate more-specific stats for backup and restore, and then
     // each can have a single Display method.
@@ -192,6 +332,8 @@ pub struct BackupStats {
     pub files: usize,
     pub symlinks: usize,
     pub directories: usize,
+    /// Named pipes and device nodes.
+    pub special_files: usize,
     pub unknown_kind: usize,
 
     pub unmodified_files: usize,
@@ -228,6 +370,7 @@ impl fmt::Display for BackupStats {
         write_count(w, "  new files", self.new_files);
         write_count(w, "symlinks", self.symlinks);
         write_count(w, "directories", self.directories);
+        write_count(w, "fifos and device nodes", self.special_files);
         write_count(w, "unsupported file kind", self.unknown_kind);
         writeln!(w).unwrap();
 
@@ -153,6 +153,11 @@ mod test {
             mtime: 0,
             mtime_nanos: 0,
             addrs: Vec::new(),
+            unix_mode: None,
+            uid: None,
+            gid: None,
+            device: None,
+            unrecoverable: false,
         }
     }
 
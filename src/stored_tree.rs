@@ -47,6 +47,26 @@ impl StoredTree {
         self.band.is_closed()
     }
 
+    /// Find the file at `apath` in this tree, and return a reader of its
+    /// content.
+    pub fn open_file(&self, apath: &Apath) -> Result<ReadStoredFile> {
+        let entry = self
+            .iter_entries(apath.clone(), Exclude::nothing())?
+            .next()
+            .filter(|entry| entry.apath == *apath)
+            .ok_or_else(|| Error::SubtreeNotFound {
+                apath: apath.clone(),
+                band_id: self.band.id().clone(),
+            })?;
+        if entry.kind() != Kind::File {
+            return Err(Error::NotAFile {
+                apath: apath.clone(),
+                kind: entry.kind(),
+            });
+        }
+        self.file_contents(&entry)
+    }
+
     /// Open a file stored within this tree.
     fn open_stored_file(&self, entry: &IndexEntry) -> StoredFile {
         StoredFile::open(self.block_dir.clone(), entry.addrs.clone())
@@ -77,6 +97,7 @@ impl ReadTree for StoredTree {
 
 #[cfg(test)]
 mod test {
+    use std::io::Read;
     use std::path::Path;
 
     use super::super::test_fixtures::*;
@@ -137,4 +158,28 @@ mod test {
 
         assert_eq!(names.as_slice(), ["/subdir", "/subdir/subfile"]);
     }
+
+    #[test]
+    fn open_file() {
+        let archive = Archive::open_path(Path::new("testdata/archive/minimal/v0.6.3/")).unwrap();
+        let st = archive
+            .open_stored_tree(BandSelectionPolicy::Latest)
+            .unwrap();
+
+        let mut content = String::new();
+        st.open_file(&"/subdir/subfile".into())
+            .unwrap()
+            .read_to_string(&mut content)
+            .unwrap();
+        assert_eq!(content, "I like Rust\n");
+
+        assert!(matches!(
+            st.open_file(&"/subdir".into()),
+            Err(Error::NotAFile { .. })
+        ));
+        assert!(matches!(
+            st.open_file(&"/nothing".into()),
+            Err(Error::SubtreeNotFound { .. })
+        ));
+    }
 }
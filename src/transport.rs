@@ -23,6 +23,8 @@ use url::Url;
 use crate::*;
 
 pub mod local;
+pub mod retry;
+pub mod throttle;
 use local::LocalTransport;
 
 /// Open a `Transport` to access a local directory.
@@ -129,6 +131,26 @@ pub trait Transport: Send + Sync + std::fmt::Debug {
     /// If a temporary file is used, the name should start with `crate::TMP_PREFIX`.
     fn write_file(&self, relpath: &str, content: &[u8]) -> io::Result<()>;
 
+    /// Write a complete file, as for `write_file`, and also make sure it's
+    /// durably stored before returning, so that it survives a crash.
+    ///
+    /// This is slower, so it's used for band heads and tails, index hunks,
+    /// and other small files that the archive's structure depends on, but
+    /// not for blocks.
+    ///
+    /// By default this is the same as `write_file`.
+    fn write_file_durably(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.write_file(relpath, content)
+    }
+
+    /// Write a complete file, failing with `io::ErrorKind::AlreadyExists` if
+    /// it's already present.
+    ///
+    /// Checking and creating the file must be a single atomic operation, so
+    /// that this can be used as a lock: if several processes try to create
+    /// the same file, exactly one of them succeeds.
+    fn create_new_file(&self, relpath: &str, content: &[u8]) -> io::Result<()>;
+
     /// Get metadata about a file.
     fn metadata(&self, relpath: &str) -> io::Result<Metadata>;
 
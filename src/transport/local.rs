@@ -39,6 +39,51 @@ impl LocalTransport {
         debug_assert!(!relpath.contains("/../"), "path must not contain /../");
         self.root.join(relpath)
     }
+
+    /// Write a file to a temporary name and rename it into place, optionally
+    /// syncing the content and the directory to disk.
+    fn write_file_inner(&self, relpath: &str, content: &[u8], sync: bool) -> io::Result<()> {
+        let full_path = self.full_path(relpath);
+        let dir = full_path.parent().unwrap();
+        let mut temp = tempfile::Builder::new()
+            .prefix(crate::TMP_PREFIX)
+            .tempfile_in(dir)?;
+        // When syncing, flush the content to disk before renaming, so that
+        // after a crash the file is either absent or complete, never empty
+        // or truncated.
+        if let Err(err) = temp.write_all(content).and_then(|()| {
+            if sync {
+                temp.as_file().sync_all()
+            } else {
+                Ok(())
+            }
+        }) {
+            let _ = temp.close();
+            return Err(err);
+        }
+        if let Err(persist_error) = temp.persist(&full_path) {
+            persist_error.file.close()?;
+            return Err(persist_error.error);
+        }
+        if sync {
+            sync_dir(dir)?;
+        }
+        Ok(())
+    }
+}
+
+/// Flush a directory to disk, so that a file just renamed into it is still
+/// there after a crash.
+#[cfg(unix)]
+fn sync_dir(dir: &Path) -> io::Result<()> {
+    File::open(dir)?.sync_all()
+}
+
+/// Directories can't be opened to sync them on Windows, and renames are
+/// already durable once they return.
+#[cfg(not(unix))]
+fn sync_dir(_dir: &Path) -> io::Result<()> {
+    Ok(())
 }
 
 impl Transport for LocalTransport {
@@ -87,16 +132,25 @@ impl Transport for LocalTransport {
     }
 
     fn write_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.write_file_inner(relpath, content, false)
+    }
+
+    fn write_file_durably(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.write_file_inner(relpath, content, true)
+    }
+
+    fn create_new_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
         let full_path = self.full_path(relpath);
-        let dir = full_path.parent().unwrap();
         let mut temp = tempfile::Builder::new()
             .prefix(crate::TMP_PREFIX)
-            .tempfile_in(dir)?;
+            .tempfile_in(full_path.parent().unwrap())?;
         if let Err(err) = temp.write_all(content) {
             let _ = temp.close();
             return Err(err);
         }
-        if let Err(persist_error) = temp.persist(&full_path) {
+        // Linking the complete file into place fails if the name is taken,
+        // so other readers never see it partly written.
+        if let Err(persist_error) = temp.persist_noclobber(&full_path) {
             persist_error.file.close()?;
             Err(persist_error.error)
         } else {
@@ -252,6 +306,23 @@ mod test {
         temp.close().unwrap();
     }
 
+    #[test]
+    fn write_file_durably() {
+        let temp = assert_fs::TempDir::new().unwrap();
+        let transport = LocalTransport::new(temp.path());
+
+        transport
+            .write_file_durably("head", b"{\"band_format_version\":\"0.6.3\"}\n")
+            .unwrap();
+
+        temp.child("head")
+            .assert("{\"band_format_version\":\"0.6.3\"}\n");
+        // No temporary files are left behind.
+        assert_eq!(std::fs::read_dir(temp.path()).unwrap().count(), 1);
+
+        temp.close().unwrap();
+    }
+
     #[test]
     fn create_existing_dir() {
         let temp = assert_fs::TempDir::new().unwrap();
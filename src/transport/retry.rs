@@ -0,0 +1,352 @@
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Retry operations on another transport that fail with transient errors.
+
+use std::io;
+use std::thread::sleep;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use bytes::Bytes;
+
+use crate::transport::{DirEntry, Metadata, Transport};
+use crate::ui;
+
+/// The longest time to wait between attempts, however many retries there
+/// have been.
+const MAX_WAIT: Duration = Duration::from_secs(60);
+
+/// How many times to retry, and how long to wait in between.
+#[derive(Debug, Clone, Copy, Eq, PartialEq)]
+pub struct RetryPolicy {
+    /// Number of times to retry after the first attempt fails.
+    pub retries: u32,
+    /// Wait before the first retry; this doubles after each further failure.
+    pub initial_wait: Duration,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        RetryPolicy {
+            retries: 0,
+            initial_wait: Duration::from_secs(1),
+        }
+    }
+}
+
+impl RetryPolicy {
+    /// Run `f`, retrying it if it fails with a transient error.
+    ///
+    /// Other errors, and the last transient error, are returned immediately.
+    pub fn run<T, F>(&self, description: &str, mut f: F) -> io::Result<T>
+    where
+        F: FnMut() -> io::Result<T>,
+    {
+        let mut attempt = 0;
+        loop {
+            match f() {
+                Err(err) if attempt < self.retries && is_transient(&err) => {
+                    let wait = self.wait_before_retry(attempt, jitter());
+                    ui::problem(&format!(
+                        "Retrying {} in {:.1}s after error: {}",
+                        description,
+                        wait.as_secs_f64(),
+                        err
+                    ));
+                    sleep(wait);
+                    attempt += 1;
+                }
+                result => return result,
+            }
+        }
+    }
+
+    /// Run `f`, which removes something, retrying it like `run`.
+    ///
+    /// An attempt that fails with a transient error might still have removed
+    /// it, so if a retry then finds it's missing that counts as success.
+    pub fn run_remove<F>(&self, description: &str, mut f: F) -> io::Result<()>
+    where
+        F: FnMut() -> io::Result<()>,
+    {
+        let mut failed_transiently = false;
+        self.run(description, || match f() {
+            Err(err) if failed_transiently && err.kind() == io::ErrorKind::NotFound => Ok(()),
+            Err(err) => {
+                failed_transiently |= is_transient(&err);
+                Err(err)
+            }
+            Ok(()) => Ok(()),
+        })
+    }
+
+    /// Return how long to wait after the given (zero-based) failed attempt.
+    ///
+    /// The wait grows exponentially, and `jitter`, between 0 and 1, scales it
+    /// down by up to half so that many clients don't all retry at once.
+    fn wait_before_retry(&self, attempt: u32, jitter: f64) -> Duration {
+        let exponential = self
+            .initial_wait
+            .saturating_mul(2u32.saturating_pow(attempt))
+            .min(MAX_WAIT);
+        exponential.mul_f64(1.0 - jitter / 2.0)
+    }
+}
+
+/// True if an error might not happen again if the operation is retried.
+///
+/// Errors such as a missing file or a permission problem fail immediately.
+fn is_transient(err: &io::Error) -> bool {
+    use io::ErrorKind::*;
+    matches!(
+        err.kind(),
+        Interrupted
+            | TimedOut
+            | WouldBlock
+            | ConnectionReset
+            | ConnectionAborted
+            | NotConnected
+            | BrokenPipe
+    )
+}
+
+/// A pseudo-random number between 0 and 1, which is good enough to spread
+/// out retries.
+fn jitter() -> f64 {
+    let nanos = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.subsec_nanos());
+    f64::from(nanos % 1000) / 1000.0
+}
+
+/// A transport that retries operations that fail with transient errors,
+/// such as a timeout or a reset connection.
+///
+/// Files are written atomically and directories are created only if they
+/// don't exist, so it's safe to retry reads, writes, and creating
+/// directories. An operation that seemed to fail might really have
+/// succeeded, though, so removals that find the file already gone after a
+/// retry count as successful, and `create_new_file` isn't retried at all:
+/// a retry would find its own file and fail with `AlreadyExists`.
+#[derive(Debug)]
+pub struct RetryTransport {
+    inner: Box<dyn Transport>,
+    policy: RetryPolicy,
+}
+
+impl RetryTransport {
+    pub fn new(inner: Box<dyn Transport>, policy: RetryPolicy) -> Self {
+        RetryTransport { inner, policy }
+    }
+}
+
+impl Transport for RetryTransport {
+    fn iter_dir_entries(
+        &self,
+        relpath: &str,
+    ) -> io::Result<Box<dyn Iterator<Item = io::Result<DirEntry>>>> {
+        self.policy.run(&format!("listing {:?}", relpath), || {
+            self.inner.iter_dir_entries(relpath)
+        })
+    }
+
+    fn read_file(&self, relpath: &str) -> io::Result<Bytes> {
+        self.policy.run(&format!("reading {:?}", relpath), || {
+            self.inner.read_file(relpath)
+        })
+    }
+
+    fn is_file(&self, relpath: &str) -> io::Result<bool> {
+        self.policy.run(&format!("checking {:?}", relpath), || {
+            self.inner.is_file(relpath)
+        })
+    }
+
+    fn is_dir(&self, relpath: &str) -> io::Result<bool> {
+        self.policy.run(&format!("checking {:?}", relpath), || {
+            self.inner.is_dir(relpath)
+        })
+    }
+
+    fn create_dir(&self, relpath: &str) -> io::Result<()> {
+        self.policy.run(&format!("creating {:?}", relpath), || {
+            self.inner.create_dir(relpath)
+        })
+    }
+
+    fn write_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.policy.run(&format!("writing {:?}", relpath), || {
+            self.inner.write_file(relpath, content)
+        })
+    }
+
+    fn write_file_durably(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.policy.run(&format!("writing {:?}", relpath), || {
+            self.inner.write_file_durably(relpath, content)
+        })
+    }
+
+    fn create_new_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        // Not retried: see the type's documentation.
+        self.inner.create_new_file(relpath, content)
+    }
+
+    fn metadata(&self, relpath: &str) -> io::Result<Metadata> {
+        self.policy.run(&format!("checking {:?}", relpath), || {
+            self.inner.metadata(relpath)
+        })
+    }
+
+    fn remove_file(&self, relpath: &str) -> io::Result<()> {
+        self.policy
+            .run_remove(&format!("removing {:?}", relpath), || {
+                self.inner.remove_file(relpath)
+            })
+    }
+
+    fn remove_dir(&self, relpath: &str) -> io::Result<()> {
+        self.policy
+            .run_remove(&format!("removing {:?}", relpath), || {
+                self.inner.remove_dir(relpath)
+            })
+    }
+
+    fn remove_dir_all(&self, relpath: &str) -> io::Result<()> {
+        self.policy
+            .run_remove(&format!("removing {:?}", relpath), || {
+                self.inner.remove_dir_all(relpath)
+            })
+    }
+
+    fn sub_transport(&self, relpath: &str) -> Box<dyn Transport> {
+        Box::new(RetryTransport {
+            inner: self.inner.sub_transport(relpath),
+            policy: self.policy,
+        })
+    }
+
+    fn url_scheme(&self) -> &'static str {
+        self.inner.url_scheme()
+    }
+}
+
+/// Parse a wait between retries such as `500ms`, `2s`, or `1m`.
+pub fn parse_retry_wait(s: &str) -> std::result::Result<Duration, String> {
+    let s = s.trim();
+    let split = s
+        .find(|c: char| !c.is_ascii_digit())
+        .ok_or_else(|| format!("Invalid wait {:?}: expected a number and unit", s))?;
+    let (number, unit) = s.split_at(split);
+    let number: u64 = number
+        .parse()
+        .map_err(|_| format!("Invalid wait {:?}: expected a number and unit", s))?;
+    match unit {
+        "ms" => Ok(Duration::from_millis(number)),
+        "s" => Ok(Duration::from_secs(number)),
+        "m" => Ok(Duration::from_secs(number * 60)),
+        _ => Err(format!("Invalid wait {:?}: unit should be ms, s, or m", s)),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::cell::Cell;
+
+    use super::*;
+
+    fn quick_policy(retries: u32) -> RetryPolicy {
+        RetryPolicy {
+            retries,
+            initial_wait: Duration::from_millis(1),
+        }
+    }
+
+    #[test]
+    fn transient_errors_are_retried() {
+        let calls = Cell::new(0);
+        let result = quick_policy(3).run("testing", || {
+            calls.set(calls.get() + 1);
+            if calls.get() < 3 {
+                Err(io::Error::from(io::ErrorKind::TimedOut))
+            } else {
+                Ok(calls.get())
+            }
+        });
+        assert_eq!(result.unwrap(), 3);
+    }
+
+    #[test]
+    fn retries_are_limited() {
+        let calls = Cell::new(0);
+        let result: io::Result<()> = quick_policy(2).run("testing", || {
+            calls.set(calls.get() + 1);
+            Err(io::Error::from(io::ErrorKind::ConnectionReset))
+        });
+        assert_eq!(result.unwrap_err().kind(), io::ErrorKind::ConnectionReset);
+        assert_eq!(calls.get(), 3);
+    }
+
+    #[test]
+    fn permanent_errors_fail_immediately() {
+        let calls = Cell::new(0);
+        let result: io::Result<()> = quick_policy(5).run("testing", || {
+            calls.set(calls.get() + 1);
+            Err(io::Error::from(io::ErrorKind::NotFound))
+        });
+        assert_eq!(result.unwrap_err().kind(), io::ErrorKind::NotFound);
+        assert_eq!(calls.get(), 1);
+    }
+
+    #[test]
+    fn missing_after_transient_failure_is_removed() {
+        let calls = Cell::new(0);
+        let result = quick_policy(3).run_remove("testing", || {
+            calls.set(calls.get() + 1);
+            if calls.get() == 1 {
+                Err(io::Error::from(io::ErrorKind::TimedOut))
+            } else {
+                Err(io::Error::from(io::ErrorKind::NotFound))
+            }
+        });
+        assert!(result.is_ok());
+        assert_eq!(calls.get(), 2);
+    }
+
+    #[test]
+    fn missing_on_first_removal_is_an_error() {
+        let result =
+            quick_policy(3).run_remove("testing", || Err(io::Error::from(io::ErrorKind::NotFound)));
+        assert_eq!(result.unwrap_err().kind(), io::ErrorKind::NotFound);
+    }
+
+    #[test]
+    fn wait_grows_exponentially_with_jitter() {
+        let policy = RetryPolicy {
+            retries: 10,
+            initial_wait: Duration::from_secs(1),
+        };
+        assert_eq!(policy.wait_before_retry(0, 0.0), Duration::from_secs(1));
+        assert_eq!(policy.wait_before_retry(3, 0.0), Duration::from_secs(8));
+        assert_eq!(policy.wait_before_retry(3, 1.0), Duration::from_secs(4));
+        assert_eq!(policy.wait_before_retry(20, 0.0), MAX_WAIT);
+    }
+
+    #[test]
+    fn parse_waits() {
+        assert_eq!(parse_retry_wait("500ms"), Ok(Duration::from_millis(500)));
+        assert_eq!(parse_retry_wait("2s"), Ok(Duration::from_secs(2)));
+        assert_eq!(parse_retry_wait("1m"), Ok(Duration::from_secs(60)));
+        assert!(parse_retry_wait("2").is_err());
+        assert!(parse_retry_wait("s").is_err());
+        assert!(parse_retry_wait("2h").is_err());
+    }
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Limit the rate at which files are written to another transport.
+
+use std::io;
+use std::sync::{Arc, Mutex};
+use std::thread::sleep;
+use std::time::{Duration, Instant};
+
+use bytes::Bytes;
+
+use crate::transport::{DirEntry, Metadata, Transport};
+
+/// A transport that delays writes so that, in aggregate, no more than a
+/// given number of bytes per second are written to the inner transport.
+///
+/// Sub-transports share the same limit, so it applies across the whole
+/// archive and across threads.
+#[derive(Debug)]
+pub struct ThrottledTransport {
+    inner: Box<dyn Transport>,
+    limiter: Arc<Mutex<RateLimiter>>,
+}
+
+impl ThrottledTransport {
+    pub fn new(inner: Box<dyn Transport>, bytes_per_second: u64) -> Self {
+        assert!(bytes_per_second > 0);
+        ThrottledTransport {
+            inner,
+            limiter: Arc::new(Mutex::new(RateLimiter::new(bytes_per_second))),
+        }
+    }
+
+    /// Wait until `len` more bytes can be written within the limit.
+    fn wait_for(&self, len: usize) {
+        // Don't hold the lock while sleeping, so other threads can reserve
+        // their own later slots.
+        let delay = self
+            .limiter
+            .lock()
+            .unwrap()
+            .reserve(len as u64, Instant::now());
+        if !delay.is_zero() {
+            sleep(delay);
+        }
+    }
+}
+
+impl Transport for ThrottledTransport {
+    fn iter_dir_entries(
+        &self,
+        relpath: &str,
+    ) -> io::Result<Box<dyn Iterator<Item = io::Result<DirEntry>>>> {
+        self.inner.iter_dir_entries(relpath)
+    }
+
+    fn read_file(&self, relpath: &str) -> io::Result<Bytes> {
+        self.inner.read_file(relpath)
+    }
+
+    fn is_file(&self, relpath: &str) -> io::Result<bool> {
+        self.inner.is_file(relpath)
+    }
+
+    fn is_dir(&self, relpath: &str) -> io::Result<bool> {
+        self.inner.is_dir(relpath)
+    }
+
+    fn create_dir(&self, relpath: &str) -> io::Result<()> {
+        self.inner.create_dir(relpath)
+    }
+
+    fn write_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.wait_for(content.len());
+        self.inner.write_file(relpath, content)
+    }
+
+    fn write_file_durably(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.wait_for(content.len());
+        self.inner.write_file_durably(relpath, content)
+    }
+
+    fn create_new_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.wait_for(content.len());
+        self.inner.create_new_file(relpath, content)
+    }
+
+    fn metadata(&self, relpath: &str) -> io::Result<Metadata> {
+        self.inner.metadata(relpath)
+    }
+
+    fn remove_file(&self, relpath: &str) -> io::Result<()> {
+        self.inner.remove_file(relpath)
+    }
+
+    fn remove_dir(&self, relpath: &str) -> io::Result<()> {
+        self.inner.remove_dir(relpath)
+    }
+
+    fn remove_dir_all(&self, relpath: &str) -> io::Result<()> {
+        self.inner.remove_dir_all(relpath)
+    }
+
+    fn sub_transport(&self, relpath: &str) -> Box<dyn Transport> {
+        Box::new(ThrottledTransport {
+            inner: self.inner.sub_transport(relpath),
+            limiter: Arc::clone(&self.limiter),
+        })
+    }
+
+    fn url_scheme(&self) -> &'static str {
+        self.inner.url_scheme()
+    }
+}
+
+/// Schedules writes so that they don't exceed an average rate.
+///
+/// Each write reserves time in proportion to its size, starting from the end
+/// of the previous reservation; the caller waits until its reservation starts.
+/// After an idle period, writes proceed immediately.
+#[derive(Debug)]
+struct RateLimiter {
+    bytes_per_second: u64,
+    /// The time at which the next write may start.
+    next_free: Option<Instant>,
+}
+
+impl RateLimiter {
+    fn new(bytes_per_second: u64) -> Self {
+        RateLimiter {
+            bytes_per_second,
+            next_free: None,
+        }
+    }
+
+    /// Reserve time to write `bytes`, and return how long to wait before
+    /// writing them.
+    fn reserve(&mut self, bytes: u64, now: Instant) -> Duration {
+        let start = match self.next_free {
+            Some(next_free) if next_free > now => next_free,
+            _ => now,
+        };
+        self.next_free =
+            Some(start + Duration::from_secs_f64(bytes as f64 / self.bytes_per_second as f64));
+        start - now
+    }
+}
+
+/// Parse a rate such as `500KB`, `2MB`, or `1000000`, in decimal bytes per
+/// second.
+///
+/// By convention, 0 means no limit.
+pub fn parse_bytes_per_second(s: &str) -> std::result::Result<u64, String> {
+    crate::misc::parse_bytes(s)
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn rate_limiter_spaces_out_writes() {
+        let mut limiter = RateLimiter::new(1000);
+        let start = Instant::now();
+        assert_eq!(limiter.reserve(500, start), Duration::ZERO);
+        assert_eq!(limiter.reserve(500, start), Duration::from_millis(500));
+        assert_eq!(limiter.reserve(1000, start), Duration::from_secs(1));
+        // After an idle period, there's no delay.
+        let later = start + Duration::from_secs(10);
+        assert_eq!(limiter.reserve(1000, later), Duration::ZERO);
+    }
+
+    #[test]
+    fn parse_rates() {
+        assert_eq!(parse_bytes_per_second("500KB"), Ok(500_000));
+        assert_eq!(parse_bytes_per_second("2MB"), Ok(2_000_000));
+        assert_eq!(parse_bytes_per_second("2mb"), Ok(2_000_000));
+        assert_eq!(parse_bytes_per_second("1GB"), Ok(1_000_000_000));
+        assert_eq!(parse_bytes_per_second("1234"), Ok(1234));
+        assert_eq!(parse_bytes_per_second("1234B"), Ok(1234));
+        assert_eq!(parse_bytes_per_second("0"), Ok(0));
+        assert!(parse_bytes_per_second("fast").is_err());
+        assert!(parse_bytes_per_second("-1MB").is_err());
+    }
+
+    #[test]
+    fn sub_transports_share_limit() {
+        let temp = assert_fs::TempDir::new().unwrap();
+        let transport = ThrottledTransport::new(
+            Box::new(crate::transport::local::LocalTransport::new(temp.path())),
+            1000,
+        );
+        let sub = transport.sub_transport("sub");
+        transport.create_dir("sub").unwrap();
+        sub.write_file("a", &[0; 500]).unwrap();
+        assert!(transport.limiter.lock().unwrap().next_free.unwrap() > Instant::now());
+        temp.close().unwrap();
+    }
+}
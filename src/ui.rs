@@ -36,6 +36,10 @@ use crate::stats::Sizes;
 pub(crate) struct UIState {
     /// Should a progress bar be drawn?
     progress_enabled: bool,
+
+    /// Write messages to stderr, so that stdout has only machine-readable
+    /// output.
+    messages_to_stderr: bool,
 }
 
 lazy_static! {
@@ -84,6 +88,12 @@ pub fn enable_progress(enabled: bool) {
     ui.progress_enabled = enabled;
 }
 
+/// Send messages and problems to stderr rather than stdout.
+pub fn messages_to_stderr(enabled: bool) {
+    let mut ui = UI_STATE.lock().unwrap();
+    ui.messages_to_stderr = enabled;
+}
+
 #[allow(unused)]
 pub(crate) fn compression_percent(s: &Sizes) -> i64 {
     if s.uncompressed > 0 {
@@ -131,13 +141,21 @@ impl UIState {
     pub(crate) fn println(&mut self, s: &str) {
         // TODO: Go through Nutmeg instead...
         // self.clear_progress();
-        println!("{}", s);
+        if self.messages_to_stderr {
+            eprintln!("{}", s);
+        } else {
+            println!("{}", s);
+        }
     }
 
     fn problem(&mut self, s: &str) {
         // TODO: Go through Nutmeg instead...
         // self.clear_progress();
-        println!("conserve error: {}", s);
+        if self.messages_to_stderr {
+            eprintln!("conserve error: {}", s);
+        } else {
+            println!("conserve error: {}", s);
+        }
         // Drawing this way makes messages leak from tests, for unclear reasons.
 
         // queue!(
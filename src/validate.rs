@@ -11,9 +11,12 @@
 // GNU General Public License for more details.
 
 use std::cmp::max;
-use std::collections::HashMap;
+use std::collections::{BTreeSet, HashMap, HashSet};
 use std::time::Instant;
 
+use itertools::Itertools;
+use serde::Serialize;
+
 use crate::blockdir::Address;
 use crate::*;
 
@@ -23,6 +26,36 @@ pub(crate) struct BlockLengths(pub(crate) HashMap<BlockHash, u64>);
 pub struct ValidateOptions {
     /// Assume blocks that are present have the right content: don't read and hash them.
     pub skip_block_hashes: bool,
+    /// Move blocks that fail validation into quarantine, and mark the files
+    /// that use any missing or damaged blocks as unrecoverable.
+    pub repair: bool,
+}
+
+/// The results of validating an archive.
+///
+/// This is shown as text, or can be serialized as JSON.
+#[derive(Debug, Clone, Serialize)]
+pub struct ValidateReport {
+    /// True if no problems were found.
+    pub ok: bool,
+    /// Bands whose indexes were checked.
+    pub bands: Vec<BandId>,
+    pub stats: ValidateStats,
+    /// Files that reference blocks that are missing or damaged.
+    pub damaged_files: Vec<DamagedFile>,
+    /// Damaged blocks that were moved into quarantine by a repair.
+    pub quarantined_blocks: Vec<BlockHash>,
+    /// Files that were marked unrecoverable by a repair.
+    pub unrecoverable_files: Vec<DamagedFile>,
+}
+
+/// A stored file that can't be completely restored.
+#[derive(Debug, Clone, Eq, PartialEq, Serialize)]
+pub struct DamagedFile {
+    pub band_id: BandId,
+    pub apath: Apath,
+    /// The missing or damaged blocks that it references.
+    pub blocks: Vec<BlockHash>,
 }
 
 impl BlockLengths {
@@ -109,7 +142,7 @@ pub(crate) fn validate_stored_tree(st: &StoredTree) -> Result<(BlockLengths, Val
     let stats = ValidateStats::default();
     for entry in st
         .iter_entries(Apath::root(), Exclude::nothing())?
-        .filter(|entry| entry.kind() == Kind::File)
+        .filter(|entry| entry.kind() == Kind::File && !entry.unrecoverable)
     {
         for addr in entry.addrs {
             block_lens.add(addr)
@@ -117,3 +150,91 @@ pub(crate) fn validate_stored_tree(st: &StoredTree) -> Result<(BlockLengths, Val
     }
     Ok((block_lens, stats))
 }
+
+/// Report each file in the given bands that references a missing or damaged
+/// block, and return a list of them.
+pub(crate) fn report_damaged_files(
+    archive: &Archive,
+    band_ids: &[BandId],
+    bad_blocks: &HashSet<BlockHash>,
+) -> Vec<DamagedFile> {
+    let mut damaged_files = Vec::new();
+    for band_id in band_ids {
+        let entries = match StoredTree::open(archive, band_id)
+            .and_then(|st| st.iter_entries(Apath::root(), Exclude::nothing()))
+        {
+            Ok(entries) => entries,
+            // Already counted as a problem by validate_bands.
+            Err(_) => continue,
+        };
+        for entry in entries.filter(|entry| entry.kind() == Kind::File && !entry.unrecoverable) {
+            let blocks: Vec<BlockHash> = entry
+                .addrs
+                .iter()
+                .map(|addr| &addr.hash)
+                .filter(|hash| bad_blocks.contains(hash))
+                .unique()
+                .cloned()
+                .collect();
+            if !blocks.is_empty() {
+                ui::problem(&format!(
+                    "File {} in backup {} references missing or damaged blocks: {}",
+                    entry.apath,
+                    band_id,
+                    blocks.iter().map(BlockHash::to_string).join(", ")
+                ));
+                damaged_files.push(DamagedFile {
+                    band_id: band_id.clone(),
+                    apath: entry.apath,
+                    blocks,
+                });
+            }
+        }
+    }
+    damaged_files
+}
+
+/// Mark damaged files as unrecoverable, and then move damaged blocks into
+/// quarantine.
+///
+/// Files are marked first, so that if this is interrupted, no file refers
+/// to a quarantined block without being marked.
+///
+/// Returns the blocks that were quarantined and the files that were newly
+/// marked.
+pub(crate) fn repair(
+    archive: &Archive,
+    damaged_blocks: &HashSet<BlockHash>,
+    damaged_files: &[DamagedFile],
+) -> Result<(Vec<BlockHash>, Vec<DamagedFile>)> {
+    let mut unrecoverable_files = Vec::new();
+    for (band_id, files) in &damaged_files.iter().group_by(|file| &file.band_id) {
+        let files: Vec<&DamagedFile> = files.collect();
+        let apaths: BTreeSet<Apath> = files.iter().map(|file| file.apath.clone()).collect();
+        Band::open(archive, band_id)?
+            .index()
+            .mark_unrecoverable(&apaths)?;
+        for file in files {
+            ui::println(&format!(
+                "Marked {} in backup {} as unrecoverable",
+                file.apath, band_id
+            ));
+            unrecoverable_files.push(file.clone());
+        }
+    }
+
+    let mut quarantined_blocks = Vec::new();
+    if !damaged_blocks.is_empty() {
+        let quarantine = archive.quarantine_transport()?;
+        for hash in damaged_blocks.iter().sorted() {
+            if archive
+                .block_dir()
+                .quarantine_block(hash, quarantine.as_ref())?
+            {
+                ui::println(&format!("Moved damaged block {} into quarantine", hash));
+                quarantined_blocks.push(hash.clone());
+            }
+        }
+    }
+    Ok((quarantined_blocks, unrecoverable_files))
+}
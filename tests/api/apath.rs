@@ -20,6 +20,13 @@ fn parse() {
     assert_eq!(apath.to_string(), "/something");
 }
 
+#[test]
+fn depth() {
+    assert_eq!(Apath::root().depth(), 0);
+    assert_eq!(Apath::from("/stuff").depth(), 1);
+    assert_eq!(Apath::from("/stuff/file").depth(), 2);
+}
+
 #[test]
 fn is_prefix_of() {
     use std::ops::Not;
@@ -12,13 +12,20 @@
 
 //! Tests focussed on backup behavior.
 
+use std::io;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
 use assert_fs::prelude::*;
 use assert_fs::TempDir;
+use bytes::Bytes;
 use filetime::{set_file_mtime, FileTime};
 
 use conserve::kind::Kind;
 use conserve::test_fixtures::ScratchArchive;
 use conserve::test_fixtures::TreeFixture;
+use conserve::transport::local::LocalTransport;
+use conserve::transport::{DirEntry, Metadata};
 use conserve::*;
 
 const HELLO_HASH: &str =
@@ -207,6 +214,43 @@ fn large_file() {
     assert_eq!(large_content, content);
 }
 
+/// With content-defined chunking, inserting data at the start of a large file
+/// doesn't stop the rest of it being deduplicated.
+#[test]
+fn content_defined_chunking_dedups_shifted_content() {
+    let af = ScratchArchive::new();
+    let tf = TreeFixture::new();
+    let options = BackupOptions {
+        chunk_sizes: Some(ChunkSizes::from_average(64 << 10)),
+        ..Default::default()
+    };
+
+    let mut state: u32 = 1;
+    let content: Vec<u8> = (0..(2 << 20))
+        .map(|_| {
+            state = state.wrapping_mul(1_103_515_245).wrapping_add(12345);
+            (state >> 16) as u8
+        })
+        .collect();
+    tf.create_file_with_contents("large", &content);
+    let stats = backup(&af, &tf.live_tree(), &options).expect("backup");
+    assert!(stats.written_blocks > 10);
+
+    let mut edited = b"new header\n".to_vec();
+    edited.extend_from_slice(&content);
+    tf.create_file_with_contents("large", &edited);
+    let stats = backup(&af, &tf.live_tree(), &options).expect("backup");
+    assert!(
+        stats.deduplicated_blocks > stats.written_blocks * 4,
+        "{:?}",
+        stats
+    );
+
+    let rd = TempDir::new().unwrap();
+    restore(&af, rd.path(), &RestoreOptions::default()).expect("restore");
+    assert_eq!(std::fs::read(rd.path().join("large")).unwrap(), edited);
+}
+
 /// If some files are unreadable, others are stored and the backup completes with warnings.
 #[cfg(unix)]
 #[test]
@@ -254,6 +298,81 @@ fn mtime_before_epoch() {
         .expect("backup shouldn't crash on before-epoch mtimes");
 }
 
+/// With `since`, only recently modified files are stored, along with the
+/// directories that contain them.
+#[test]
+fn backup_since_skips_old_files() {
+    let tf = TreeFixture::new();
+    let old_time = FileTime::from_unix_time(1_000_000_000, 0);
+    tf.create_dir("old");
+    set_file_mtime(tf.create_file("old/a"), old_time).unwrap();
+    set_file_mtime(tf.create_file("old_file"), old_time).unwrap();
+    tf.create_dir("new");
+    tf.create_file("new/b");
+    tf.create_dir("new/sub");
+    tf.create_file("new/sub/c");
+    tf.create_file("recent");
+
+    let af = ScratchArchive::new();
+    let options = BackupOptions {
+        since: Some(chrono::Utc::now() - chrono::Duration::hours(1)),
+        ..Default::default()
+    };
+    let stats = backup(&af, &tf.live_tree(), &options).expect("backup");
+    assert_eq!(stats.files, 3);
+
+    let apaths: Vec<String> = af
+        .open_stored_tree(BandSelectionPolicy::Latest)
+        .unwrap()
+        .iter_entries(Apath::root(), Exclude::nothing())
+        .unwrap()
+        .map(|entry| entry.apath().to_string())
+        .collect();
+    assert_eq!(
+        apaths,
+        ["/", "/new", "/recent", "/new/b", "/new/sub", "/new/sub/c"]
+    );
+}
+
+/// Files outside the size limits aren't stored, and the limits combine with
+/// `since` and glob exclusions.
+#[test]
+fn backup_size_limits_skip_files() {
+    let tf = TreeFixture::new();
+    tf.create_file_with_contents("empty", b"");
+    tf.create_file_with_contents("small", b"hello");
+    tf.create_file_with_contents("large", &[b'x'; 2000]);
+    tf.create_file_with_contents("excluded", b"hello");
+    tf.create_dir("old");
+    set_file_mtime(
+        tf.create_file_with_contents("old/small", b"hello"),
+        FileTime::from_unix_time(1_000_000_000, 0),
+    )
+    .unwrap();
+    tf.create_dir("big");
+    tf.create_file_with_contents("big/large", &[b'x'; 2000]);
+
+    let af = ScratchArchive::new();
+    let options = BackupOptions {
+        exclude: Exclude::from_strings(&["/excluded"]).unwrap(),
+        since: Some(chrono::Utc::now() - chrono::Duration::hours(1)),
+        exclude_larger_than: Some(1000),
+        exclude_smaller_than: Some(1),
+        ..Default::default()
+    };
+    let stats = backup(&af, &tf.live_tree(), &options).expect("backup");
+    assert_eq!(stats.files, 1);
+
+    let apaths: Vec<String> = af
+        .open_stored_tree(BandSelectionPolicy::Latest)
+        .unwrap()
+        .iter_entries(Apath::root(), Exclude::nothing())
+        .unwrap()
+        .map(|entry| entry.apath().to_string())
+        .collect();
+    assert_eq!(apaths, ["/", "/small"]);
+}
+
 #[cfg(unix)]
 #[test]
 pub fn symlink() {
@@ -556,3 +675,265 @@ fn detect_unchanged_from_stitched_index() {
     assert_eq!(stats.unmodified_files, 2, "both files are unmodified");
     assert_eq!(stats.index_builder_stats.index_hunks, 3);
 }
+
+#[test]
+fn verify_detects_corrupt_block() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_file_with_contents("a", b"some contents");
+    let stats = backup(
+        &af,
+        &srcdir.live_tree(),
+        &BackupOptions {
+            verify: true,
+            ..Default::default()
+        },
+    )
+    .unwrap();
+    assert_eq!(stats.errors, 0);
+
+    // Replace the stored block with different, but validly compressed, content.
+    let hash = af
+        .block_dir()
+        .block_names()
+        .unwrap()
+        .next()
+        .unwrap()
+        .to_string();
+    let mut compressor = conserve::compress::snappy::Compressor::new();
+    af.transport()
+        .write_file(
+            &format!("d/{}/{}", &hash[..3], hash),
+            compressor.compress(b"other contents").unwrap(),
+        )
+        .unwrap();
+
+    // Touch the file so that it's read again and matched to the existing block.
+    set_file_mtime(
+        srcdir.path().join("a"),
+        FileTime::from_unix_time(1_000_000_000, 0),
+    )
+    .unwrap();
+    let result = backup(
+        &af,
+        &srcdir.live_tree(),
+        &BackupOptions {
+            verify: true,
+            ..Default::default()
+        },
+    );
+    assert!(
+        matches!(result, Err(Error::BlockCorrupt { .. })),
+        "{:?}",
+        result
+    );
+}
+
+#[test]
+fn select_backup_by_label() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_file("hello");
+    for label in ["nightly", "pre-upgrade", "nightly"] {
+        let options = BackupOptions {
+            label: Some(label.to_owned()),
+            ..BackupOptions::default()
+        };
+        backup(&af, &srcdir.live_tree(), &options).unwrap();
+    }
+
+    let band = Band::open(&af, &BandId::new(&[1])).unwrap();
+    assert_eq!(band.label(), Some("pre-upgrade"));
+    assert_eq!(
+        band.get_info().unwrap().label.as_deref(),
+        Some("pre-upgrade")
+    );
+    assert_eq!(
+        af.resolve_band_id(BandSelectionPolicy::Labelled("pre-upgrade".to_owned()))
+            .unwrap(),
+        BandId::new(&[1])
+    );
+    match af.resolve_band_id(BandSelectionPolicy::Labelled("nightly".to_owned())) {
+        Err(Error::AmbiguousLabel { band_ids, .. }) => {
+            assert_eq!(band_ids, [BandId::new(&[0]), BandId::new(&[2])])
+        }
+        other => panic!("unexpected result {:?}", other),
+    }
+    assert!(matches!(
+        af.resolve_band_id(BandSelectionPolicy::Labelled("weekly".to_owned())),
+        Err(Error::LabelNotFound { .. })
+    ));
+}
+
+#[test]
+fn label_like_band_id_is_rejected() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    let options = BackupOptions {
+        label: Some("b0001".to_owned()),
+        ..BackupOptions::default()
+    };
+    assert!(matches!(
+        backup(&af, &srcdir.live_tree(), &options),
+        Err(Error::InvalidLabel { .. })
+    ));
+    assert!(af.list_band_ids().unwrap().is_empty());
+}
+
+/// A transport whose `write_file`, which is used for blocks, can be made to
+/// fail.
+#[derive(Debug)]
+struct FailingBlockWrites {
+    inner: Box<dyn Transport>,
+    fail: Arc<AtomicBool>,
+}
+
+impl Transport for FailingBlockWrites {
+    fn iter_dir_entries(
+        &self,
+        relpath: &str,
+    ) -> io::Result<Box<dyn Iterator<Item = io::Result<DirEntry>>>> {
+        self.inner.iter_dir_entries(relpath)
+    }
+
+    fn read_file(&self, relpath: &str) -> io::Result<Bytes> {
+        self.inner.read_file(relpath)
+    }
+
+    fn create_dir(&self, relpath: &str) -> io::Result<()> {
+        self.inner.create_dir(relpath)
+    }
+
+    fn write_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        if self.fail.load(Ordering::Relaxed) {
+            Err(io::Error::new(io::ErrorKind::Other, "injected failure"))
+        } else {
+            self.inner.write_file(relpath, content)
+        }
+    }
+
+    fn write_file_durably(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.inner.write_file_durably(relpath, content)
+    }
+
+    fn create_new_file(&self, relpath: &str, content: &[u8]) -> io::Result<()> {
+        self.inner.create_new_file(relpath, content)
+    }
+
+    fn metadata(&self, relpath: &str) -> io::Result<Metadata> {
+        self.inner.metadata(relpath)
+    }
+
+    fn remove_file(&self, relpath: &str) -> io::Result<()> {
+        self.inner.remove_file(relpath)
+    }
+
+    fn remove_dir(&self, relpath: &str) -> io::Result<()> {
+        self.inner.remove_dir(relpath)
+    }
+
+    fn remove_dir_all(&self, relpath: &str) -> io::Result<()> {
+        self.inner.remove_dir_all(relpath)
+    }
+
+    fn sub_transport(&self, relpath: &str) -> Box<dyn Transport> {
+        Box::new(FailingBlockWrites {
+            inner: self.inner.sub_transport(relpath),
+            fail: self.fail.clone(),
+        })
+    }
+
+    fn url_scheme(&self) -> &'static str {
+        self.inner.url_scheme()
+    }
+}
+
+/// If a combined block of small files can't be stored, the backup fails,
+/// rather than completing with those files missing from the index.
+#[test]
+fn failure_to_store_combined_block_stops_backup() {
+    let temp = TempDir::new().unwrap();
+    let fail = Arc::new(AtomicBool::new(true));
+    let archive = Archive::create_with_options(
+        Box::new(FailingBlockWrites {
+            inner: Box::new(LocalTransport::new(temp.path())),
+            fail: fail.clone(),
+        }),
+        &ArchiveOptions {
+            // Small blocks, so that a few small files fill a combined block.
+            block_size: Some(4096),
+            ..ArchiveOptions::default()
+        },
+    )
+    .unwrap();
+    let srcdir = TreeFixture::new();
+    for i in 0..20 {
+        srcdir.create_file_with_contents(&format!("file{:02}", i), &[i; 800]);
+    }
+    // With one thread, each combined block is stored as soon as it's full,
+    // before the end of the backup.
+    let pool = rayon::ThreadPoolBuilder::new()
+        .num_threads(1)
+        .build()
+        .unwrap();
+
+    let result = pool.install(|| backup(&archive, &srcdir.live_tree(), &BackupOptions::default()));
+    assert!(result.is_err(), "{:?}", result);
+    assert!(archive.last_complete_band().unwrap().is_none());
+
+    fail.store(false, Ordering::Relaxed);
+    let stats = pool
+        .install(|| backup(&archive, &srcdir.live_tree(), &BackupOptions::default()))
+        .unwrap();
+    assert_eq!(stats.errors, 0);
+    let names: Vec<String> = archive
+        .open_stored_tree(BandSelectionPolicy::LatestClosed)
+        .unwrap()
+        .iter_entries(Apath::root(), Exclude::nothing())
+        .unwrap()
+        .filter(|entry| entry.kind() == Kind::File)
+        .map(|entry| entry.apath().to_string())
+        .collect();
+    assert_eq!(names.len(), 20);
+}
+
+#[test]
+fn failed_backup_updates_manifest() {
+    let temp = TempDir::new().unwrap();
+    let fail = Arc::new(AtomicBool::new(true));
+    let archive = Archive::create_with_options(
+        Box::new(FailingBlockWrites {
+            inner: Box::new(LocalTransport::new(temp.path())),
+            fail,
+        }),
+        &ArchiveOptions {
+            block_size: Some(4096),
+            signed: true,
+            ..ArchiveOptions::default()
+        },
+    )
+    .unwrap();
+    let header = std::fs::read_to_string(temp.path().join("CONSERVE")).unwrap();
+    assert!(header.contains(r#""conserve_archive_version":"0.6.17""#));
+    let key = ManifestKey::from_passphrase(&archive, "correct horse").unwrap();
+    write_manifest(&archive, &key).unwrap();
+    let srcdir = TreeFixture::new();
+    for i in 0..20 {
+        srcdir.create_file_with_contents(&format!("file{:02}", i), &[i; 800]);
+    }
+    let options = BackupOptions {
+        manifest_key: Some(key.clone()),
+        ..BackupOptions::default()
+    };
+
+    let pool = rayon::ThreadPoolBuilder::new()
+        .num_threads(1)
+        .build()
+        .unwrap();
+    let result = pool.install(|| backup(&archive, &srcdir.live_tree(), &options));
+    assert!(result.is_err(), "{:?}", result);
+
+    // The incomplete band is in the manifest.
+    let report = verify_manifest(&archive, &key).unwrap();
+    assert!(!report.has_problems(), "{:?}", report);
+}
@@ -13,8 +13,12 @@
 
 //! Test validation of archives with some problems.
 
+use std::collections::HashSet;
 use std::path::Path;
 
+use tempfile::TempDir;
+
+use conserve::test_fixtures::{ScratchArchive, TreeFixture};
 use conserve::*;
 
 #[test]
@@ -33,8 +37,77 @@ fn missing_block_skip_block_hashes() -> Result<()> {
 
     let validate_stats = archive.validate(&ValidateOptions {
         skip_block_hashes: true,
+        ..Default::default()
     })?;
     assert!(validate_stats.has_problems());
     assert_eq!(validate_stats.block_missing_count, 1);
     Ok(())
 }
+
+#[test]
+fn repair_quarantines_damaged_block() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_file_with_contents("a", b"good contents");
+    backup(&af, &srcdir.live_tree(), &Default::default()).unwrap();
+    let good_blocks = af.block_dir().block_names_set().unwrap();
+    srcdir.create_file_with_contents("b", b"contents that will be damaged");
+    backup(&af, &srcdir.live_tree(), &Default::default()).unwrap();
+    let new_blocks: HashSet<BlockHash> = af
+        .block_dir()
+        .block_names_set()
+        .unwrap()
+        .difference(&good_blocks)
+        .cloned()
+        .collect();
+    assert_eq!(new_blocks.len(), 1);
+    let damaged_hash = new_blocks.into_iter().next().unwrap();
+    let hash = damaged_hash.to_string();
+    af.transport()
+        .write_file(&format!("d/{}/{}", &hash[..3], hash), b"garbage")
+        .unwrap();
+
+    let report = af
+        .validate_report(&ValidateOptions {
+            repair: true,
+            ..Default::default()
+        })
+        .unwrap();
+    assert!(!report.ok);
+    assert_eq!(report.quarantined_blocks, [damaged_hash.clone()]);
+    assert_eq!(report.unrecoverable_files.len(), 1);
+    assert_eq!(report.unrecoverable_files[0].apath, "/b");
+    assert_eq!(report.unrecoverable_files[0].band_id, BandId::new(&[1]));
+    assert!(af.path().join("quarantine").join(&hash).is_file());
+    assert!(!af.block_dir().contains(&damaged_hash).unwrap());
+    for hash in &good_blocks {
+        assert!(af.block_dir().contains(hash).unwrap());
+    }
+
+    // Once repaired, the archive is valid, and the damaged file is skipped
+    // by restore.
+    let report = af.validate_report(&ValidateOptions::default()).unwrap();
+    assert!(report.ok, "{:?}", report);
+    let restore_dir = TempDir::new().unwrap();
+    let stats = restore(&af, restore_dir.path(), &Default::default()).unwrap();
+    assert_eq!(stats.files, 1);
+    assert_eq!(stats.unrecoverable_files, 1);
+    assert!(restore_dir.path().join("a").is_file());
+    assert!(!restore_dir.path().join("b").exists());
+
+    // The next backup stores the unrecoverable file again, even though the
+    // source hasn't changed, and then it can be restored.
+    let backup_stats = backup(&af, &srcdir.live_tree(), &Default::default()).unwrap();
+    assert_eq!(backup_stats.unmodified_files, 1);
+    assert_eq!(backup_stats.modified_files, 1);
+    assert!(af.block_dir().contains(&damaged_hash).unwrap());
+    let report = af.validate_report(&ValidateOptions::default()).unwrap();
+    assert!(report.ok, "{:?}", report);
+    let restore_dir = TempDir::new().unwrap();
+    let stats = restore(&af, restore_dir.path(), &Default::default()).unwrap();
+    assert_eq!(stats.files, 2);
+    assert_eq!(
+        std::fs::read(restore_dir.path().join("b")).unwrap(),
+        b"contents that will be damaged"
+    );
+}
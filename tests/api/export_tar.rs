@@ -0,0 +1,98 @@
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Tests for exporting stored trees as tar files.
+
+use std::io::Read;
+
+use conserve::test_fixtures::ScratchArchive;
+use conserve::*;
+
+/// Return the path, type, and content of every entry in a tar file.
+fn tar_contents(tar_bytes: &[u8]) -> Vec<(String, tar::EntryType, Vec<u8>)> {
+    let mut archive = tar::Archive::new(tar_bytes);
+    archive
+        .entries()
+        .unwrap()
+        .map(|entry| {
+            let mut entry = entry.unwrap();
+            let path = entry.path().unwrap().to_string_lossy().into_owned();
+            let entry_type = entry.header().entry_type();
+            let mut content = Vec::new();
+            entry.read_to_end(&mut content).unwrap();
+            (path, entry_type, content)
+        })
+        .collect()
+}
+
+#[test]
+fn export_latest_version() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let mut tar_bytes = Vec::new();
+    let stats = export_tar(&af, &mut tar_bytes, &ExportTarOptions::default()).unwrap();
+    assert_eq!(stats.files, 3);
+    assert_eq!(stats.directories, 2);
+
+    let contents = tar_contents(&tar_bytes);
+    let files: Vec<(&str, &[u8])> = contents
+        .iter()
+        .filter(|(_, entry_type, _)| *entry_type == tar::EntryType::Regular)
+        .map(|(path, _, content)| (path.as_str(), content.as_slice()))
+        .collect();
+    assert_eq!(
+        files,
+        [
+            ("hello", &b"contents"[..]),
+            ("hello2", &b"contents"[..]),
+            ("subdir/subfile", &b"contents"[..]),
+        ]
+    );
+    assert!(contents
+        .iter()
+        .any(|(path, entry_type, _)| path == "subdir" && entry_type.is_dir()));
+    if SYMLINKS_SUPPORTED {
+        let mut archive = tar::Archive::new(tar_bytes.as_slice());
+        let link = archive
+            .entries()
+            .unwrap()
+            .map(Result::unwrap)
+            .find(|entry| entry.header().entry_type().is_symlink())
+            .unwrap();
+        assert_eq!(link.path().unwrap().to_str(), Some("link"));
+        assert_eq!(link.link_name().unwrap().unwrap().to_str(), Some("target"));
+    }
+}
+
+#[test]
+fn export_subtree_gzipped() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let options = ExportTarOptions {
+        only_subtree: Some(Apath::from("/subdir")),
+        band_selection: BandSelectionPolicy::Specified(BandId::new(&[0])),
+        gzip: true,
+        ..ExportTarOptions::default()
+    };
+    let mut gz_bytes = Vec::new();
+    export_tar(&af, &mut gz_bytes, &options).unwrap();
+
+    let mut tar_bytes = Vec::new();
+    flate2::read::GzDecoder::new(gz_bytes.as_slice())
+        .read_to_end(&mut tar_bytes)
+        .unwrap();
+    let paths: Vec<String> = tar_contents(&tar_bytes)
+        .into_iter()
+        .map(|(path, _, _)| path)
+        .collect();
+    assert_eq!(paths, ["subdir", "subdir/subfile"]);
+}
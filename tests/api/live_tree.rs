@@ -53,7 +53,7 @@ fn list_simple_directory() {
     );
 
     let repr = format!("{:?}", &result[6]);
-    let re = Regex::new(r#"LiveEntry \{ apath: Apath\("/jam/apricot"\), kind: File, mtime: UnixTime \{ [^)]* \}, size: Some\(8\), symlink_target: None \}"#).unwrap();
+    let re = Regex::new(r#"LiveEntry \{ apath: Apath\("/jam/apricot"\), kind: File, mtime: UnixTime \{ [^)]* \}, size: Some\(8\), symlink_target: None, unix_mode: [^,]*, uid: [^,]*, gid: [^,]*, device: None \}"#).unwrap();
     assert!(re.is_match(&repr));
 
     // TODO: Somehow get the stats out of the iterator.
@@ -126,9 +126,27 @@ fn exclude_cachedir() {
     cachedir::add_tag(&cache_dir).unwrap();
 
     let lt = LiveTree::open(tf.path()).unwrap();
+    let mut iter = lt.iter_entries(Apath::root(), Exclude::nothing()).unwrap();
+    let names: Vec<String> = iter.by_ref().map(|e| e.apath().to_string()).collect();
+    assert_eq!(names, ["/", "/a"]);
+    assert_eq!(iter.stats().cache_dirs, 1);
+}
+
+/// Everything in a tree on a single filesystem is still listed with
+/// `one_file_system`.
+#[test]
+fn one_file_system_includes_same_device() {
+    let tf = TreeFixture::new();
+    tf.create_file("a");
+    tf.create_dir("subdir");
+    tf.create_file("subdir/b");
+
+    let lt = LiveTree::open(tf.path())
+        .unwrap()
+        .with_one_file_system(true);
     let names =
         entry_iter_to_apath_strings(lt.iter_entries(Apath::root(), Exclude::nothing()).unwrap());
-    assert_eq!(names, ["/", "/a"]);
+    assert_eq!(names, ["/", "/a", "/subdir", "/subdir/b"]);
 }
 
 /// Collect apaths from an iterator into a list of string.
@@ -18,8 +18,10 @@ mod blockhash;
 mod damaged;
 mod delete;
 mod diff;
+mod export_tar;
 mod gc;
 mod live_tree;
+mod observer;
 mod old_archives;
 mod restore;
 mod transport;
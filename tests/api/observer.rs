@@ -0,0 +1,103 @@
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Tests for observing the progress of backups and restores.
+
+use std::sync::{Arc, Mutex};
+
+use tempfile::TempDir;
+
+use conserve::test_fixtures::{ScratchArchive, TreeFixture};
+use conserve::*;
+
+/// Remembers every event, as a string.
+#[derive(Debug, Default)]
+struct RecordingObserver {
+    events: Mutex<Vec<String>>,
+}
+
+impl RecordingObserver {
+    fn push(&self, event: String) {
+        self.events.lock().unwrap().push(event);
+    }
+
+    fn events(&self) -> Vec<String> {
+        self.events.lock().unwrap().clone()
+    }
+}
+
+impl Observer for RecordingObserver {
+    fn file_started(&self, apath: &Apath) {
+        self.push(format!("started {}", apath));
+    }
+
+    fn file_completed(&self, apath: &Apath, bytes: u64) {
+        self.push(format!("completed {} {}", apath, bytes));
+    }
+
+    fn block_stored(&self, _hash: &BlockHash, len: usize) {
+        self.push(format!("block {}", len));
+    }
+}
+
+#[test]
+fn backup_and_restore_report_events() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_file_with_contents("hello", b"hello world");
+    srcdir.create_dir("subdir");
+    srcdir.create_file_with_contents("subdir/again", b"hello world");
+
+    let observer = Arc::new(RecordingObserver::default());
+    let options = BackupOptions {
+        observer: Some(observer.clone()),
+        ..BackupOptions::default()
+    };
+    backup(&af, &srcdir.live_tree(), &options).unwrap();
+    // Both small files are stored together in one block.
+    assert_eq!(
+        observer.events(),
+        [
+            "started /hello",
+            "completed /hello 11",
+            "started /subdir/again",
+            "completed /subdir/again 11",
+            "block 22",
+        ]
+    );
+
+    // Nothing has changed, so no new blocks are stored.
+    let observer = Arc::new(RecordingObserver::default());
+    let options = BackupOptions {
+        observer: Some(observer.clone()),
+        ..BackupOptions::default()
+    };
+    backup(&af, &srcdir.live_tree(), &options).unwrap();
+    assert!(!observer.events().iter().any(|e| e.starts_with("block")));
+
+    let observer = Arc::new(RecordingObserver::default());
+    let restore_dir = TempDir::new().unwrap();
+    let options = RestoreOptions {
+        observer: Some(observer.clone()),
+        ..RestoreOptions::default()
+    };
+    restore(&af, restore_dir.path(), &options).unwrap();
+    assert_eq!(
+        observer.events(),
+        [
+            "started /hello",
+            "completed /hello 11",
+            "started /subdir/again",
+            "completed /subdir/again 11",
+        ]
+    );
+}
@@ -96,6 +96,229 @@ pub fn forced_overwrite() {
     assert!(dest.join("existing").is_file());
 }
 
+#[test]
+pub fn overwrite_counts_replaced_files() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let destdir = TreeFixture::new();
+    destdir.create_file_with_contents("hello", b"local changes");
+
+    let options = RestoreOptions {
+        overwrite: true,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.overwritten, 1);
+    assert_eq!(stats.skipped_existing, 0);
+    assert_ne!(
+        std::fs::read(destdir.path().join("hello")).unwrap(),
+        b"local changes"
+    );
+}
+
+#[test]
+pub fn skip_existing_files() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let destdir = TreeFixture::new();
+    destdir.create_file_with_contents("hello", b"local changes");
+
+    let options = RestoreOptions {
+        skip_existing: true,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.skipped_existing, 1);
+    assert_eq!(stats.overwritten, 0);
+    assert_eq!(stats.errors, 0);
+    let dest = destdir.path();
+    assert_eq!(std::fs::read(dest.join("hello")).unwrap(), b"local changes");
+    assert!(dest.join("hello2").is_file());
+    assert!(dest.join("subdir/subfile").is_file());
+}
+
+#[test]
+pub fn merge_keeps_newer_files() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let destdir = TreeFixture::new();
+    let newer = destdir.create_file_with_contents("hello", b"local changes");
+    filetime::set_file_mtime(&newer, FileTime::from_unix_time(4_000_000_000, 0)).unwrap();
+    let older = destdir.create_file_with_contents("hello2", b"old version");
+    filetime::set_file_mtime(&older, FileTime::from_unix_time(1_000_000_000, 0)).unwrap();
+
+    let options = RestoreOptions {
+        merge: true,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.kept_newer, 1);
+    assert_eq!(stats.overwritten, 1);
+    assert_eq!(stats.errors, 0);
+    let dest = destdir.path();
+    assert_eq!(std::fs::read(dest.join("hello")).unwrap(), b"local changes");
+    assert_eq!(std::fs::read(dest.join("hello2")).unwrap(), b"contents");
+    assert!(dest.join("subdir/subfile").is_file());
+
+    // Restoring again keeps everything, because it all has the same mtime
+    // and size as the backup, or is newer.
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.overwritten, 0);
+    assert_eq!(stats.errors, 0);
+}
+
+#[test]
+pub fn merge_takes_precedence_over_skip_existing() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let destdir = TreeFixture::new();
+    let older = destdir.create_file_with_contents("hello2", b"old version");
+    filetime::set_file_mtime(&older, FileTime::from_unix_time(1_000_000_000, 0)).unwrap();
+
+    let options = RestoreOptions {
+        merge: true,
+        skip_existing: true,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.overwritten, 1);
+    assert_eq!(stats.skipped_existing, 0);
+    assert_eq!(
+        std::fs::read(destdir.path().join("hello2")).unwrap(),
+        b"contents"
+    );
+}
+
+#[test]
+pub fn verify_restored_files() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let destdir = TreeFixture::new();
+    let options = RestoreOptions {
+        verify: true,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.verified_files, stats.files);
+    assert_eq!(stats.verify_failures, 0);
+    assert_eq!(stats.errors, 0);
+}
+
+#[test]
+pub fn restore_sparse_file() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    let mut content = vec![0u8; 1 << 22];
+    content[..5].copy_from_slice(b"hello");
+    srcdir.create_file_with_contents("sparse", &content);
+    srcdir.create_file_with_contents("zeros", &[0u8; 100_000]);
+    backup(&af, &srcdir.live_tree(), &BackupOptions::default()).unwrap();
+
+    let destdir = TreeFixture::new();
+    let options = RestoreOptions {
+        sparse: true,
+        verify: true,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.verify_failures, 0);
+    assert_eq!(
+        std::fs::read(destdir.path().join("sparse")).unwrap(),
+        content
+    );
+    assert_eq!(
+        std::fs::read(destdir.path().join("zeros")).unwrap(),
+        [0u8; 100_000]
+    );
+    // The runs of zeros were left as holes, so less space is allocated than
+    // the file's length.
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::MetadataExt;
+        let metadata = std::fs::metadata(destdir.path().join("sparse")).unwrap();
+        assert_eq!(metadata.len(), content.len() as u64);
+        assert!(
+            metadata.blocks() * 512 < metadata.len(),
+            "{} blocks allocated for {} bytes",
+            metadata.blocks(),
+            metadata.len()
+        );
+    }
+}
+
+#[test]
+fn restore_one_file_to_writer() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let options = RestoreOptions {
+        only_subtree: Some(Apath::from("/subdir/subfile")),
+        ..RestoreOptions::default()
+    };
+    let mut content = Vec::new();
+    let stats = restore_to_writer(&af, &mut content, &options).unwrap();
+    assert_eq!(content, b"contents");
+    assert_eq!(stats.files, 1);
+    assert_eq!(stats.uncompressed_file_bytes, 8);
+}
+
+#[test]
+fn restore_directory_to_writer_fails() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    for only_subtree in [None, Some(Apath::from("/subdir"))] {
+        let options = RestoreOptions {
+            only_subtree,
+            ..RestoreOptions::default()
+        };
+        let mut content = Vec::new();
+        let err = restore_to_writer(&af, &mut content, &options).unwrap_err();
+        assert!(
+            matches!(
+                err,
+                Error::RestoreToStdoutNotAFile {
+                    kind: Kind::Dir,
+                    ..
+                }
+            ),
+            "{:?}",
+            err
+        );
+        assert!(content.is_empty());
+    }
+}
+
+/// Names that differ only in their Unicode normalization collide when
+/// they're normalized.
+///
+/// macOS won't store both names in the source tree.
+#[cfg(not(target_os = "macos"))]
+#[test]
+fn normalized_names_collide() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_file_with_contents("caf\u{e9}", b"composed");
+    srcdir.create_file_with_contents("cafe\u{301}", b"decomposed");
+    backup(&af, &srcdir.live_tree(), &BackupOptions::default()).unwrap();
+
+    let destdir = TreeFixture::new();
+    let options = RestoreOptions {
+        normalize: Normalization::Nfc,
+        ..RestoreOptions::default()
+    };
+    let stats = restore(&af, destdir.path(), &options).expect("restore");
+    assert_eq!(stats.errors, 1);
+    // The entry that was restored first is not overwritten.
+    let names: Vec<_> = std::fs::read_dir(destdir.path())
+        .unwrap()
+        .map(|entry| entry.unwrap().file_name())
+        .collect();
+    assert_eq!(names, ["caf\u{e9}"]);
+    assert_eq!(
+        std::fs::read(destdir.path().join("caf\u{e9}")).unwrap(),
+        b"decomposed"
+    );
+}
+
 #[test]
 fn exclude_files() {
     let af = ScratchArchive::new();
@@ -144,3 +367,151 @@ fn restore_symlink() {
         PathBuf::from("target")
     );
 }
+
+#[test]
+#[cfg(unix)]
+fn restore_fifo() {
+    use std::os::unix::fs::{FileTypeExt, PermissionsExt};
+
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    let fifo_path = srcdir.path().join("fifo");
+    let status = std::process::Command::new("mkfifo")
+        .arg("-m")
+        .arg("640")
+        .arg(&fifo_path)
+        .status()
+        .unwrap();
+    assert!(status.success());
+
+    let header_path = af.path().join("CONSERVE");
+    assert_eq!(
+        std::fs::read_to_string(&header_path).unwrap(),
+        "{\"conserve_archive_version\":\"0.6\"}\n"
+    );
+    let backup_stats = backup(&af, &srcdir.live_tree(), &Default::default()).unwrap();
+    assert_eq!(backup_stats.special_files, 1);
+    assert_eq!(backup_stats.unknown_kind, 0);
+    // Older versions of Conserve can't read the new kind, so are now refused.
+    assert_eq!(
+        std::fs::read_to_string(&header_path).unwrap(),
+        "{\"conserve_archive_version\":\"0.6.17\"}\n"
+    );
+
+    let restore_dir = TempDir::new().unwrap();
+    let restore_stats = restore(&af, restore_dir.path(), &Default::default()).unwrap();
+    assert_eq!(restore_stats.special_files, 1);
+    let metadata = symlink_metadata(restore_dir.path().join("fifo")).unwrap();
+    assert!(metadata.file_type().is_fifo());
+    assert_eq!(metadata.permissions().mode() & 0o777, 0o640);
+}
+
+#[test]
+fn restore_empty_directories() {
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_dir("spool");
+    srcdir.create_dir("spool/empty");
+    srcdir.create_dir("cache");
+    let years_ago = UnixTime {
+        secs: 189216000,
+        nanosecs: 0,
+    };
+    for name in ["spool/empty", "spool", "cache"] {
+        filetime::set_file_mtime(srcdir.path().join(name), years_ago.into()).unwrap();
+    }
+
+    backup(&af, &srcdir.live_tree(), &Default::default()).unwrap();
+
+    let restore_dir = TempDir::new().unwrap();
+    let stats = restore(&af, restore_dir.path(), &Default::default()).unwrap();
+    assert_eq!(stats.files, 0);
+    for name in ["spool/empty", "spool", "cache"] {
+        let path = restore_dir.path().join(name);
+        assert!(path.is_dir(), "{} should be restored", name);
+        assert_eq!(
+            UnixTime::from(path.metadata().unwrap().modified().unwrap()),
+            years_ago,
+            "mtime of {}",
+            name
+        );
+    }
+}
+
+#[test]
+fn restore_only_missing_subtree_fails() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let tempdir = TempDir::new().unwrap();
+    let dest = tempdir.path().join("dest");
+
+    let options = RestoreOptions {
+        only_subtree: Some(Apath::from("/nonexistent")),
+        ..RestoreOptions::default()
+    };
+    let err = restore(&af, &dest, &options).unwrap_err();
+    assert!(matches!(err, Error::SubtreeNotFound { .. }), "{:?}", err);
+    assert_eq!(
+        err.to_string(),
+        "Path /nonexistent is not present in backup b0001"
+    );
+    assert!(!dest.exists(), "destination should not be created");
+}
+
+#[cfg(unix)]
+#[test]
+fn restore_unix_permissions() {
+    use std::fs::{metadata, set_permissions, Permissions};
+    use std::os::unix::fs::PermissionsExt;
+
+    let af = ScratchArchive::new();
+    let srcdir = TreeFixture::new();
+    srcdir.create_file("hello");
+    srcdir.create_dir("private");
+    srcdir.create_file("private/secret");
+    set_permissions(srcdir.path().join("hello"), Permissions::from_mode(0o640)).unwrap();
+    set_permissions(
+        srcdir.path().join("private/secret"),
+        Permissions::from_mode(0o600),
+    )
+    .unwrap();
+    set_permissions(srcdir.path().join("private"), Permissions::from_mode(0o750)).unwrap();
+
+    backup(&af, &srcdir.live_tree(), &Default::default()).unwrap();
+
+    let restore_dir = TempDir::new().unwrap();
+    let options = RestoreOptions {
+        no_owner: true,
+        ..RestoreOptions::default()
+    };
+    restore(&af, restore_dir.path(), &options).unwrap();
+
+    let mode = |name: &str| {
+        metadata(restore_dir.path().join(name))
+            .unwrap()
+            .permissions()
+            .mode()
+            & 0o7777
+    };
+    assert_eq!(mode("hello"), 0o640);
+    assert_eq!(mode("private"), 0o750);
+    assert_eq!(mode("private/secret"), 0o600);
+}
+
+#[test]
+fn restore_nonexistent_band_lists_available() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+    let destdir = TreeFixture::new();
+
+    let options = RestoreOptions {
+        band_selection: BandSelectionPolicy::Specified(BandId::new(&[9])),
+        ..RestoreOptions::default()
+    };
+    let err = restore(&af, destdir.path(), &options).unwrap_err();
+    assert!(matches!(err, Error::BandNotFound { .. }), "{:?}", err);
+    assert_eq!(
+        err.to_string(),
+        "Backup b0009 does not exist; available backups are: b0000, b0001"
+    );
+}
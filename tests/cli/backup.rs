@@ -12,6 +12,7 @@
 // GNU General Public License for more details.
 
 use assert_cmd::prelude::*;
+use assert_fs::TempDir;
 
 use conserve::test_fixtures::{ScratchArchive, TreeFixture};
 
@@ -33,3 +34,62 @@ fn backup_verbose() {
         .success()
         .stdout("+ /subdir/a\n+ /subdir/b\n");
 }
+
+#[test]
+fn backup_dry_run() {
+    let af = ScratchArchive::new();
+    let src = TreeFixture::new();
+    src.create_dir("subdir");
+    src.create_file("subdir/a");
+
+    run_conserve()
+        .args(&["backup", "--no-stats"])
+        .arg(af.path())
+        .arg(src.path())
+        .assert()
+        .success();
+
+    src.create_file("subdir/b");
+    run_conserve()
+        .args(&["backup", "--dry-run"])
+        .arg(af.path())
+        .arg(src.path())
+        .assert()
+        .success()
+        .stdout("+ /subdir/b\nBackup dry run: would store 1 files, 0 MB.\n");
+
+    // Nothing new was written.
+    run_conserve()
+        .args(&["versions", "--short"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout("b0000\n");
+}
+
+#[test]
+fn backup_stats_json() {
+    let af = ScratchArchive::new();
+    let src = TreeFixture::new();
+    src.create_dir("subdir");
+    src.create_file("subdir/a");
+    src.create_file("subdir/b");
+    let stats_dir = TempDir::new().unwrap();
+    let stats_path = stats_dir.path().join("stats.json");
+
+    run_conserve()
+        .args(&["backup", "--no-stats", "--stats-json"])
+        .arg(&stats_path)
+        .arg(af.path())
+        .arg(src.path())
+        .assert()
+        .success();
+
+    let json: serde_json::Value =
+        serde_json::from_str(&std::fs::read_to_string(&stats_path).unwrap()).unwrap();
+    assert_eq!(json["files"], 2);
+    assert_eq!(json["new_files"], 2);
+    assert_eq!(json["directories"], 2);
+    assert_eq!(json["errors"], 0);
+    assert_eq!(json["index_builder_stats"]["index_hunks"], 1);
+}
@@ -51,6 +51,18 @@ fn setup_symlink() -> (ScratchArchive, TreeFixture) {
     (af, tf)
 }
 
+#[test]
+fn failure_exits_2() {
+    let tf = TreeFixture::new();
+
+    run_conserve()
+        .arg("diff")
+        .arg(tf.path().join("no-such-archive"))
+        .arg(tf.path())
+        .assert()
+        .code(2);
+}
+
 #[test]
 fn no_changes() {
     let (af, tf) = setup();
@@ -86,7 +98,7 @@ fn add_entries() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout("+\t/src\n+\t/src/new.rs\n")
         .stderr(predicate::str::is_empty());
 }
@@ -101,7 +113,7 @@ fn remove_file() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout("-\t/hello.c\n")
         .stderr(predicate::str::is_empty());
 
@@ -111,7 +123,7 @@ fn remove_file() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout(".\t/\n-\t/hello.c\n.\t/subdir\n")
         .stderr(predicate::str::is_empty());
 }
@@ -127,7 +139,7 @@ fn change_kind() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout("*\t/subdir\n")
         .stderr(predicate::str::is_empty());
 
@@ -137,7 +149,7 @@ fn change_kind() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout(".\t/\n.\t/hello.c\n*\t/subdir\n")
         .stderr(predicate::str::is_empty());
 }
@@ -153,7 +165,7 @@ fn change_file_content() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout("*\t/hello.c\n")
         .stderr(predicate::str::is_empty());
 
@@ -163,7 +175,7 @@ fn change_file_content() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout(".\t/\n*\t/hello.c\n.\t/subdir\n")
         .stderr(predicate::str::is_empty());
 }
@@ -205,7 +217,7 @@ pub fn symlink_changed() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout("*\t/subdir/link\n")
         .stderr(predicate::str::is_empty());
 
@@ -215,7 +227,7 @@ pub fn symlink_changed() {
         .arg(af.path())
         .arg(tf.path())
         .assert()
-        .success()
+        .code(1)
         .stdout(".\t/\n.\t/subdir\n*\t/subdir/link\n")
         .stderr(predicate::str::is_empty());
 }
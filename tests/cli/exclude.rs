@@ -145,3 +145,39 @@ fn exclude_from_file() {
         .assert()
         .success();
 }
+
+#[test]
+fn exclude_from_conserveignore_in_source() {
+    let af = ScratchArchive::new();
+    let src = TreeFixture::new();
+
+    src.create_dir("src");
+    src.create_file("src/hello.c");
+    src.create_file("src/hello.o");
+    src.create_dir("node_modules");
+    src.create_file("node_modules/junk.js");
+    src.create_file_with_contents(".conserveignore", b"# build output\n*.o\n/node_modules\n");
+
+    run_conserve()
+        .args(&["backup", "-v", "--no-stats"])
+        .arg(&af.path())
+        .arg(&src.path())
+        .assert()
+        .stdout("+ /.conserveignore\n+ /src/hello.c\n")
+        .success();
+
+    run_conserve()
+        .args(&["diff"])
+        .arg(&af.path())
+        .arg(&src.path())
+        .assert()
+        .stdout("")
+        .success();
+
+    run_conserve()
+        .args(&["ls", "--source"])
+        .arg(&src.path())
+        .assert()
+        .stdout("/\n/.conserveignore\n/src\n/src/hello.c\n")
+        .success();
+}
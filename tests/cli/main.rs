@@ -28,6 +28,8 @@ mod backup;
 mod delete;
 mod diff;
 mod exclude;
+mod manifest;
+mod prune;
 mod versions;
 
 fn run_conserve() -> Command {
@@ -368,6 +370,27 @@ fn restore_only_subtree() {
     dest.close().unwrap();
 }
 
+#[test]
+fn restore_merge_summary_is_hidden_by_no_stats() {
+    let dest = TempDir::new().unwrap();
+    run_conserve()
+        .args(&["restore", "--merge"])
+        .arg("testdata/archive/minimal/v0.6.3/")
+        .arg(&dest.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("Merged: kept 0 existing entries"));
+    run_conserve()
+        .args(&["restore", "--merge", "--no-stats"])
+        .arg("testdata/archive/minimal/v0.6.3/")
+        .arg(&dest.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("Merged").not());
+
+    dest.close().unwrap();
+}
+
 #[test]
 fn size_exclude() {
     let source = TreeFixture::new();
@@ -382,3 +405,144 @@ fn size_exclude() {
         .success()
         .stdout("10\n");
 }
+
+#[test]
+fn check_source() {
+    let source = TreeFixture::new();
+    source.create_file_with_contents("small", b"0123456789");
+
+    run_conserve()
+        .arg("check-source")
+        .arg(&source.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("0      unreadable files"));
+
+    run_conserve()
+        .arg("check-source")
+        .arg(&source.path())
+        .arg(&source.path().join("nonexistent"))
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains("Failed to read source tree"));
+}
+
+#[test]
+fn restore_only_missing_subtree() {
+    let dest = TempDir::new().unwrap();
+    run_conserve()
+        .args(&[
+            "restore",
+            "testdata/archive/minimal/v0.6.3/",
+            "--only",
+            "/nothing",
+        ])
+        .arg(&dest.path().join("restore"))
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains(
+            "Path /nothing is not present in backup b0000",
+        ));
+
+    dest.child("restore").assert(predicate::path::missing());
+}
+
+#[test]
+fn cat_file() {
+    run_conserve()
+        .args(&["cat", "testdata/archive/minimal/v0.6.3/", "/subdir/subfile"])
+        .assert()
+        .success()
+        .stdout("I like Rust\n");
+}
+
+#[test]
+fn cat_directory_fails() {
+    run_conserve()
+        .args(&["cat", "testdata/archive/minimal/v0.6.3/", "/subdir"])
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains("Path /subdir is not a file"));
+}
+
+#[test]
+fn ls_long_subtree() {
+    run_conserve()
+        .args(&[
+            "ls",
+            "-l",
+            "--utc",
+            "--only",
+            "/subdir",
+            "testdata/archive/minimal/v0.6.3/",
+        ])
+        .assert()
+        .success()
+        .stdout(
+            predicate::str::is_match(
+                r"^d +\d{4}-\d\d-\d\d \d\d:\d\d:\d\d /subdir
+- +12 \d{4}-\d\d-\d\d \d\d:\d\d:\d\d /subdir/subfile
+$",
+            )
+            .unwrap(),
+        );
+}
+
+#[test]
+fn ls_depth() {
+    run_conserve()
+        .args(&["ls", "--depth=1", "testdata/archive/minimal/v0.6.3/"])
+        .assert()
+        .success()
+        .stdout("/\n/hello\n/subdir\n");
+    run_conserve()
+        .args(&[
+            "ls",
+            "--depth=0",
+            "--only",
+            "/subdir",
+            "testdata/archive/minimal/v0.6.3/",
+        ])
+        .assert()
+        .success()
+        .stdout("/subdir\n");
+}
+
+#[test]
+fn validate_reports_files_with_missing_blocks() {
+    for quick in [false, true] {
+        let mut command = run_conserve();
+        command.arg("validate");
+        if quick {
+            command.arg("--quick");
+        }
+        command
+            .arg("testdata/damaged/missing-block/")
+            .assert()
+            .stdout(predicate::str::contains(
+                "File /hello in backup b0000 references missing or damaged blocks: fec91c70284c72d0d4e3684788a90de9338a5b2f47f01fedbe203cafd68708718ae5672d10eca804a8121904047d40d1d6cf11e7a76419357a9469af41f22d01",
+            ))
+            .stdout(predicate::str::contains("/subdir/subfile").not())
+            .code(2);
+    }
+}
+
+#[test]
+fn validate_json_report() {
+    let output = run_conserve()
+        .args(&["validate", "--json", "testdata/damaged/missing-block/"])
+        .assert()
+        .stderr(predicate::str::contains("Archive has some problems."))
+        .code(2)
+        .get_output()
+        .clone();
+    let report: serde_json::Value = serde_json::from_slice(&output.stdout).unwrap();
+    assert_eq!(report["archive"], "testdata/damaged/missing-block/");
+    assert_eq!(report["ok"], false);
+    assert_eq!(report["bands"], serde_json::json!(["b0000"]));
+    assert_eq!(report["stats"]["block_missing_count"], 1);
+    let damaged_files = report["damaged_files"].as_array().unwrap();
+    assert_eq!(damaged_files.len(), 1);
+    assert_eq!(damaged_files[0]["band_id"], "b0000");
+    assert_eq!(damaged_files[0]["apath"], "/hello");
+}
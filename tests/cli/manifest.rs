@@ -0,0 +1,113 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Test signed archives and `conserve verify-manifest`.
+
+use std::fs;
+
+use assert_cmd::prelude::*;
+use assert_fs::prelude::*;
+use assert_fs::TempDir;
+use predicates::prelude::*;
+
+use crate::run_conserve;
+
+#[test]
+fn signed_archive_detects_added_file() {
+    let testdir = TempDir::new().unwrap();
+    let archive = testdir.child("archive");
+    let src = testdir.child("src");
+    src.create_dir_all().unwrap();
+    src.child("hello").write_str("hello world").unwrap();
+
+    run_conserve()
+        .args(&["init", "--sign"])
+        .arg(archive.path())
+        .env_remove("CONSERVE_PASSPHRASE")
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains("--key-file"));
+    archive.assert(predicate::path::missing());
+
+    run_conserve()
+        .args(&["init", "--sign"])
+        .arg(archive.path())
+        .env("CONSERVE_PASSPHRASE", "correct horse")
+        .assert()
+        .success();
+
+    // The passphrase is needed to update the manifest.
+    run_conserve()
+        .arg("backup")
+        .arg(archive.path())
+        .arg(src.path())
+        .env_remove("CONSERVE_PASSPHRASE")
+        .assert()
+        .failure();
+    run_conserve()
+        .arg("backup")
+        .arg(archive.path())
+        .arg(src.path())
+        .env("CONSERVE_PASSPHRASE", "correct horse")
+        .assert()
+        .success();
+
+    run_conserve()
+        .arg("verify-manifest")
+        .arg(archive.path())
+        .env("CONSERVE_PASSPHRASE", "correct horse")
+        .assert()
+        .success()
+        .stdout(predicate::str::contains("Archive matches its manifest"));
+
+    run_conserve()
+        .arg("verify-manifest")
+        .arg(archive.path())
+        .env("CONSERVE_PASSPHRASE", "wrong")
+        .assert()
+        .code(2)
+        .stdout(predicate::str::contains("signature is wrong"));
+
+    // Something added to a band outside Conserve is found.
+    fs::write(archive.path().join("b0000").join("extra"), b"sneaky").unwrap();
+    run_conserve()
+        .arg("verify-manifest")
+        .arg(archive.path())
+        .env("CONSERVE_PASSPHRASE", "correct horse")
+        .assert()
+        .code(2)
+        .stdout(predicate::str::contains(
+            "File isn't in manifest: b0000/extra",
+        ));
+}
+
+#[test]
+fn key_file_signs_archive() {
+    let testdir = TempDir::new().unwrap();
+    let archive = testdir.child("archive");
+    let key_file = testdir.child("key");
+    key_file.write_str("a long random key").unwrap();
+
+    run_conserve()
+        .args(&["init", "--sign", "--key-file"])
+        .arg(key_file.path())
+        .arg(archive.path())
+        .assert()
+        .success();
+    run_conserve()
+        .args(&["verify-manifest", "--key-file"])
+        .arg(key_file.path())
+        .arg(archive.path())
+        .assert()
+        .success();
+}
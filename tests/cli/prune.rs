@@ -0,0 +1,113 @@
+// Conserve backup system.
+// Copyright 2022 Martin Pool.
+
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+//! Test `conserve prune`.
+
+use assert_cmd::prelude::*;
+use assert_fs::prelude::*;
+use assert_fs::TempDir;
+use predicates::prelude::*;
+
+use conserve::test_fixtures::ScratchArchive;
+use conserve::BandId;
+
+use crate::run_conserve;
+
+#[test]
+fn prune_keep_last() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+
+    run_conserve()
+        .args(&["prune", "--keep-last=1", "--no-stats"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout("Deleted b0000\n");
+
+    assert_eq!(af.list_band_ids().unwrap(), &[BandId::new(&[1])]);
+
+    // Blocks still used by b0001 are kept.
+    let rd = TempDir::new().unwrap();
+    run_conserve()
+        .arg("restore")
+        .arg(af.path())
+        .arg(rd.path())
+        .assert()
+        .success();
+    rd.child("hello").assert(predicate::eq("contents"));
+    rd.child("hello2").assert(predicate::eq("contents"));
+
+    run_conserve()
+        .arg("validate")
+        .arg(af.path())
+        .assert()
+        .success();
+}
+
+#[test]
+fn prune_dry_run() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+
+    run_conserve()
+        .args(&["prune", "--keep-last=1", "--dry-run", "--no-stats"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout("Would delete b0000\n");
+
+    assert_eq!(af.list_band_ids().unwrap().len(), 2);
+}
+
+#[test]
+fn prune_keep_within_keeps_recent() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+
+    run_conserve()
+        .args(&["prune", "--keep-within=1d", "--no-stats"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout("");
+
+    assert_eq!(af.list_band_ids().unwrap().len(), 2);
+}
+
+#[test]
+fn prune_without_rules_fails() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+
+    run_conserve()
+        .args(&["prune", "--no-stats"])
+        .arg(af.path())
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains("No retention rules given"));
+
+    assert_eq!(af.list_band_ids().unwrap().len(), 2);
+}
+
+#[test]
+fn prune_invalid_duration() {
+    let af = ScratchArchive::new();
+
+    run_conserve()
+        .args(&["prune", "--keep-within=3y"])
+        .arg(af.path())
+        .assert()
+        .failure()
+        .stderr(predicate::str::contains("unit should be h, d, or w"));
+}
@@ -14,7 +14,7 @@
 //! Tests of the `conserve versions` command.
 
 use assert_cmd::prelude::*;
-use conserve::test_fixtures::ScratchArchive;
+use conserve::test_fixtures::{ScratchArchive, TreeFixture};
 use predicates::function::function;
 use predicates::prelude::*;
 
@@ -115,3 +115,144 @@ fn short_newest_first() {
         .stderr(predicate::str::is_empty())
         .stdout("b0001\nb0000\n");
 }
+
+#[test]
+fn json_shows_shared_blocks() {
+    let af = ScratchArchive::new();
+    af.store_two_versions();
+
+    let output = run_conserve()
+        .args(&["versions", "--json"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .get_output()
+        .stdout
+        .clone();
+    let json: serde_json::Value = serde_json::from_slice(&output).unwrap();
+    let versions = json.as_array().unwrap();
+    assert_eq!(versions.len(), 2);
+    assert_eq!(versions[0]["id"], "b0000");
+    assert_eq!(versions[0]["is_complete"], true);
+    // The second version reuses the block holding the first version's files,
+    // and adds one for the new file.
+    assert_eq!(versions[0]["blocks"], 1);
+    assert_eq!(versions[0]["new_blocks"], 1);
+    assert_eq!(versions[0]["unique_blocks"], 0);
+    assert_eq!(versions[1]["id"], "b0001");
+    assert_eq!(versions[1]["blocks"], 2);
+    assert_eq!(versions[1]["new_blocks"], 1);
+    assert_eq!(versions[1]["unique_blocks"], 1);
+    assert_eq!(versions[1]["missing_blocks"], 0);
+}
+
+#[test]
+fn labels_are_shown_and_selectable() {
+    let af = ScratchArchive::new();
+    let src = TreeFixture::new();
+    src.create_file("hello");
+    run_conserve()
+        .args(&["backup", "--label", "pre-upgrade"])
+        .arg(af.path())
+        .arg(src.path())
+        .assert()
+        .success();
+    run_conserve()
+        .arg("backup")
+        .arg(af.path())
+        .arg(src.path())
+        .assert()
+        .success();
+
+    run_conserve()
+        .args(&["versions", "--utc"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout(
+            predicate::str::is_match(
+                r"^b0000 +\d{4}-\d\d-\d\d \d\d:\d\d:\d\d +\d+:\d\d pre-upgrade
+b0001 +\d{4}-\d\d-\d\d \d\d:\d\d:\d\d +\d+:\d\d
+$",
+            )
+            .unwrap(),
+        );
+    // The short form is just the version ids.
+    run_conserve()
+        .args(&["versions", "--short"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout("b0000\nb0001\n");
+
+    run_conserve()
+        .args(&["ls", "-b", "pre-upgrade"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout("/\n/hello\n");
+    run_conserve()
+        .args(&["ls", "-b", "nightly"])
+        .arg(af.path())
+        .assert()
+        .failure()
+        .stdout(predicate::str::contains(
+            "No backup has the label \"nightly\"",
+        ));
+}
+
+#[test]
+fn info_for_old_version() {
+    run_conserve()
+        .args(&["info", "--utc", "testdata/archive/simple/v0.6.10", "b1"])
+        .assert()
+        .success()
+        .stdout(
+            "\
+version:           b0001
+start time:        2021-03-04 13:21:30
+end time:          2021-03-04 13:21:30
+duration:          0:00
+hostname:          unknown
+source:            unknown
+conserve version:  unknown
+index hunks:       1
+",
+        );
+}
+
+#[test]
+fn info_and_verbose_versions_show_origin() {
+    let af = ScratchArchive::new();
+    let src = TreeFixture::new();
+    src.create_file("hello");
+    run_conserve()
+        .args(&["backup"])
+        .arg(af.path())
+        .arg(src.path())
+        .assert()
+        .success();
+    let source = src.path().canonicalize().unwrap().display().to_string();
+
+    run_conserve()
+        .args(&["info"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains(format!(
+            "source:            {}\n",
+            source
+        )))
+        .stdout(predicate::str::contains(format!(
+            "conserve version:  {}\n",
+            conserve::version()
+        )));
+
+    run_conserve()
+        .args(&["versions", "-v"])
+        .arg(af.path())
+        .assert()
+        .success()
+        .stdout(predicate::str::contains(conserve::version()))
+        .stdout(predicate::str::contains(source));
+}